@@ -0,0 +1,24 @@
+package client
+
+import (
+	"math/rand"
+	"time"
+)
+
+// backoffDelay returns how long to wait before retry number attempt
+// (starting at 1): base doubled per attempt, capped at max, with the upper
+// half randomised so many clients don't reconnect in lockstep.
+func backoffDelay(base, max time.Duration, attempt int) time.Duration {
+	delay := base
+	for i := 1; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	half := delay / 2
+	if half <= 0 {
+		return delay
+	}
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
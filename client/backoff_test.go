@@ -0,0 +1,37 @@
+package client
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	tests := []struct {
+		name     string
+		base     time.Duration
+		max      time.Duration
+		attempt  int
+		min, cap time.Duration // jitter keeps the delay within [min, cap]
+	}{
+		{name: "first attempt", base: time.Second, max: time.Minute, attempt: 1, min: 500 * time.Millisecond, cap: time.Second},
+		{name: "second attempt doubles", base: time.Second, max: time.Minute, attempt: 2, min: time.Second, cap: 2 * time.Second},
+		{name: "third attempt", base: time.Second, max: time.Minute, attempt: 3, min: 2 * time.Second, cap: 4 * time.Second},
+		{name: "fourth attempt", base: time.Second, max: time.Minute, attempt: 4, min: 4 * time.Second, cap: 8 * time.Second},
+		{name: "fifth attempt", base: time.Second, max: time.Minute, attempt: 5, min: 8 * time.Second, cap: 16 * time.Second},
+		{name: "capped", base: time.Second, max: 10 * time.Second, attempt: 5, min: 5 * time.Second, cap: 10 * time.Second},
+		{name: "far past the cap", base: time.Second, max: 30 * time.Second, attempt: 1000, min: 15 * time.Second, cap: 30 * time.Second},
+		{name: "max below base", base: 10 * time.Second, max: 2 * time.Second, attempt: 1, min: time.Second, cap: 2 * time.Second},
+		{name: "tiny delay", base: time.Nanosecond, max: time.Minute, attempt: 1, min: 0, cap: time.Nanosecond},
+		{name: "zero base", base: 0, max: time.Minute, attempt: 3, min: 0, cap: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := 0; i < 1000; i++ {
+				d := backoffDelay(tt.base, tt.max, tt.attempt)
+				if d < 0 || d < tt.min || d > tt.cap || d > tt.max {
+					t.Fatalf("backoffDelay(%v, %v, %d) = %v, want within [%v, %v]", tt.base, tt.max, tt.attempt, d, tt.min, tt.cap)
+				}
+			}
+		})
+	}
+}
@@ -5,14 +5,17 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -44,19 +47,65 @@ func Main() {
 
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.ngopen/config.yaml)")
 	rootCmd.PersistentFlags().String("hostname", "AUTO", "Subdomain to register or 'AUTO' to let server generate one")
-	rootCmd.PersistentFlags().String("local", "", "Local service to forward to")
-	rootCmd.PersistentFlags().String("server", "connect.n.sbn.lol:9000", "Tunnel server address")
-	rootCmd.PersistentFlags().Duration("reconnect-delay", 5*time.Second, "Delay between reconnection attempts")
-	rootCmd.PersistentFlags().Bool("preserve-ip", true, "Preserve original client IP in X-Forwarded-For header")
+	rootCmd.PersistentFlags().String("local", "", "Local service to forward to, or a comma-separated list to balance across")
+	rootCmd.PersistentFlags().StringArray("route", nil, "Send matching paths to another local service: PATH=TARGET[;strip], e.g. '/api/*=localhost:8000;strip' (repeatable)")
+	rootCmd.PersistentFlags().String("host-header", hostHeaderPreserve, "Host header sent to the local service: preserve, rewrite (use the local address) or a literal value")
+	rootCmd.PersistentFlags().StringArray("request-header", nil, "Change a request header before it reaches the local service: add:Name=value, set:Name=value or remove:Name (repeatable)")
+	rootCmd.PersistentFlags().StringArray("response-header", nil, "Change a response header before it is sent back: add:Name=value, set:Name=value or remove:Name (repeatable)")
+	rootCmd.PersistentFlags().Bool("local-insecure", false, "Skip certificate verification for https:// local services")
+	rootCmd.PersistentFlags().String("local-ca", "", "PEM file with extra CA certificates to trust for https:// local services")
+	rootCmd.PersistentFlags().String("local-strategy", upstreamRoundRobin, "How to balance across several --local addresses: round-robin or least-conn")
+	rootCmd.PersistentFlags().String("server", "connect.n.sbn.lol:9000", "Tunnel server address, or a comma-separated list to fail over between")
+	rootCmd.PersistentFlags().String("server-discovery", "", "File listing tunnel servers to choose from")
+	rootCmd.PersistentFlags().Duration("reconnect-delay", 5*time.Second, "Initial delay between reconnection attempts")
+	rootCmd.PersistentFlags().Duration("reconnect-max-delay", time.Minute, "Maximum delay between reconnection attempts")
+	rootCmd.PersistentFlags().Int("max-retries", 0, "Give up after this many consecutive failed attempts (0 = retry forever)")
+	rootCmd.PersistentFlags().Bool("retry-initial", false, "Keep retrying if the very first connection fails")
+	rootCmd.PersistentFlags().String("health-check", "tcp", "Probe the local service with 'tcp', an HTTP path such as /healthz, or 'off'")
+	rootCmd.PersistentFlags().Duration("health-check-interval", 10*time.Second, "How often to probe the local service")
+	rootCmd.PersistentFlags().String("offline-page", "", "HTML file to show visitors when your local service is unreachable")
+	rootCmd.PersistentFlags().Bool("preserve-ip", true, "Pass the visitor's IP to the local service in X-Forwarded-For and Forwarded")
 	rootCmd.PersistentFlags().String("auth", "", "Authentication token for server")
+	rootCmd.PersistentFlags().String("pool", "", "Share --hostname with your other tunnels: round-robin, least-inflight or sticky")
+	rootCmd.PersistentFlags().String("domain", "", "Custom domain to attach to the tunnel (must be verified)")
+	rootCmd.PersistentFlags().String("basic-auth", "", "Require visitors to log in with user:pass before reaching your service")
+	rootCmd.PersistentFlags().StringSlice("oidc-allow-emails", nil, "Require visitors to log in with one of these emails")
+	rootCmd.PersistentFlags().StringSlice("oidc-allow-domains", nil, "Require visitors to log in with an email from one of these domains")
+	rootCmd.PersistentFlags().StringSlice("allow-cidr", nil, "Only accept visitors from these CIDR ranges")
+	rootCmd.PersistentFlags().StringSlice("deny-cidr", nil, "Reject visitors from these CIDR ranges")
+	rootCmd.PersistentFlags().Duration("keepalive-interval", 15*time.Second, "How often to ping the server on the control stream")
+	rootCmd.PersistentFlags().Duration("keepalive-timeout", 45*time.Second, "Reconnect if the server is silent for this long")
 	rootCmd.PersistentFlags().BoolVar(&debugMode, "debug", false, "Show detailed debug logs and errors")
 
 	viper.BindPFlag("hostname", rootCmd.PersistentFlags().Lookup("hostname"))
 	viper.BindPFlag("local", rootCmd.PersistentFlags().Lookup("local"))
+	viper.BindPFlag("route", rootCmd.PersistentFlags().Lookup("route"))
+	viper.BindPFlag("host-header", rootCmd.PersistentFlags().Lookup("host-header"))
+	viper.BindPFlag("request-header", rootCmd.PersistentFlags().Lookup("request-header"))
+	viper.BindPFlag("response-header", rootCmd.PersistentFlags().Lookup("response-header"))
+	viper.BindPFlag("local-insecure", rootCmd.PersistentFlags().Lookup("local-insecure"))
+	viper.BindPFlag("local-ca", rootCmd.PersistentFlags().Lookup("local-ca"))
+	viper.BindPFlag("local-strategy", rootCmd.PersistentFlags().Lookup("local-strategy"))
 	viper.BindPFlag("server", rootCmd.PersistentFlags().Lookup("server"))
+	viper.BindPFlag("server-discovery", rootCmd.PersistentFlags().Lookup("server-discovery"))
 	viper.BindPFlag("reconnect-delay", rootCmd.PersistentFlags().Lookup("reconnect-delay"))
+	viper.BindPFlag("reconnect-max-delay", rootCmd.PersistentFlags().Lookup("reconnect-max-delay"))
+	viper.BindPFlag("max-retries", rootCmd.PersistentFlags().Lookup("max-retries"))
+	viper.BindPFlag("retry-initial", rootCmd.PersistentFlags().Lookup("retry-initial"))
+	viper.BindPFlag("health-check", rootCmd.PersistentFlags().Lookup("health-check"))
+	viper.BindPFlag("health-check-interval", rootCmd.PersistentFlags().Lookup("health-check-interval"))
+	viper.BindPFlag("offline-page", rootCmd.PersistentFlags().Lookup("offline-page"))
 	viper.BindPFlag("preserve-ip", rootCmd.PersistentFlags().Lookup("preserve-ip"))
 	viper.BindPFlag("auth", rootCmd.PersistentFlags().Lookup("auth"))
+	viper.BindPFlag("pool", rootCmd.PersistentFlags().Lookup("pool"))
+	viper.BindPFlag("domain", rootCmd.PersistentFlags().Lookup("domain"))
+	viper.BindPFlag("basic-auth", rootCmd.PersistentFlags().Lookup("basic-auth"))
+	viper.BindPFlag("oidc-allow-emails", rootCmd.PersistentFlags().Lookup("oidc-allow-emails"))
+	viper.BindPFlag("oidc-allow-domains", rootCmd.PersistentFlags().Lookup("oidc-allow-domains"))
+	viper.BindPFlag("allow-cidr", rootCmd.PersistentFlags().Lookup("allow-cidr"))
+	viper.BindPFlag("deny-cidr", rootCmd.PersistentFlags().Lookup("deny-cidr"))
+	viper.BindPFlag("keepalive-interval", rootCmd.PersistentFlags().Lookup("keepalive-interval"))
+	viper.BindPFlag("keepalive-timeout", rootCmd.PersistentFlags().Lookup("keepalive-timeout"))
 	viper.BindPFlag("debug", rootCmd.PersistentFlags().Lookup("debug"))
 
 	cobra.OnInitialize(initConfig)
@@ -101,7 +150,7 @@ func Main() {
 		},
 	}
 	configCmd.AddCommand(configSetCmd, configGetCmd, configListCmd)
-	rootCmd.AddCommand(configCmd)
+	rootCmd.AddCommand(configCmd, newServeCmd())
 
 	if err := rootCmd.Execute(); err != nil {
 		color.Red("❌ %v", err)
@@ -141,13 +190,23 @@ func configPath() string {
 }
 
 func runClient(cmd *cobra.Command, args []string) {
+	runTunnel(cmd, nil)
+}
+
+// runTunnel connects and serves until stopped. Requests no route matches go
+// to files when it is set, and to --local otherwise.
+func runTunnel(cmd *cobra.Command, files *fileServer) {
 	debugMode = viper.GetBool("debug")
 	hostname := viper.GetString("hostname")
 	local := viper.GetString("local")
 	server := viper.GetString("server")
 	reconnectDelay := viper.GetDuration("reconnect-delay")
+	reconnectMaxDelay := viper.GetDuration("reconnect-max-delay")
+	maxRetries := viper.GetInt("max-retries")
+	retryInitial := viper.GetBool("retry-initial")
 	preserveClientIP := viper.GetBool("preserve-ip")
 	authToken := viper.GetString("auth")
+	basicAuth := viper.GetString("basic-auth")
 
 	// If no flags or arguments are provided, show usage and return
 	if len(os.Args) == 1 || (hostname == "AUTO" && local == "" && server == "tunnel.n.sbn.lol:9000" && authToken == "") {
@@ -155,7 +214,15 @@ func runClient(cmd *cobra.Command, args []string) {
 		return
 	}
 
-	if hostname == "" || local == "" {
+	routes, err := parseRoutes(viper.GetStringSlice("route"), viper.GetString("local-strategy"))
+	if err != nil {
+		userError("%v", err)
+		return
+	}
+	if files != nil {
+		local = ""
+	}
+	if hostname == "" || (local == "" && len(routes) == 0 && files == nil) {
 		cmd.Help()
 		return
 	}
@@ -163,6 +230,74 @@ func runClient(cmd *cobra.Command, args []string) {
 		cmd.Help()
 		return
 	}
+	if basicAuth != "" && !strings.Contains(basicAuth, ":") {
+		userError("--basic-auth must be in user:pass form")
+		return
+	}
+
+	opts := tunnelOptions{
+		Local:             local,
+		Upstreams:         newUpstreamPool(local, viper.GetString("local-strategy")),
+		Routes:            routes,
+		Files:             files,
+		HostHeader:        viper.GetString("host-header"),
+		Server:            server,
+		PreserveClientIP:  preserveClientIP,
+		AuthToken:         authToken,
+		Domain:            viper.GetString("domain"),
+		Pool:              viper.GetString("pool"),
+		BasicAuth:         basicAuth,
+		OIDCEmails:        viper.GetStringSlice("oidc-allow-emails"),
+		OIDCDomains:       viper.GetStringSlice("oidc-allow-domains"),
+		AllowCIDRs:        viper.GetStringSlice("allow-cidr"),
+		DenyCIDRs:         viper.GetStringSlice("deny-cidr"),
+		KeepaliveInterval: viper.GetDuration("keepalive-interval"),
+		KeepaliveTimeout:  viper.GetDuration("keepalive-timeout"),
+	}
+
+	if strategy := opts.Upstreams.strategy; strategy != upstreamRoundRobin && strategy != upstreamLeastConn {
+		userError("--local-strategy must be round-robin or least-conn")
+		return
+	}
+	if opts.HTTPClient, err = newLocalHTTPClient(viper.GetBool("local-insecure"), viper.GetString("local-ca")); err != nil {
+		userError("Could not load --local-ca: %v", err)
+		return
+	}
+	if opts.RequestHeaders, err = protocol.ParseHeaderRules(viper.GetStringSlice("request-header")); err != nil {
+		userError("--request-header: %v", err)
+		return
+	}
+	if opts.ResponseHeaders, err = protocol.ParseHeaderRules(viper.GetStringSlice("response-header")); err != nil {
+		userError("--response-header: %v", err)
+		return
+	}
+	if opts.Pool != "" && !protocol.ValidPoolStrategy(opts.Pool) {
+		userError("--pool must be round-robin, least-inflight or sticky")
+		return
+	}
+
+	if path := viper.GetString("offline-page"); path != "" {
+		page, err := os.ReadFile(path)
+		if err != nil {
+			userError("Could not read --offline-page: %v", err)
+			return
+		}
+		opts.OfflinePage = page
+	}
+
+	if check := viper.GetString("health-check"); check != "off" && check != "tcp" && !strings.HasPrefix(check, "/") {
+		userError("--health-check must be 'tcp', 'off' or an HTTP path starting with /")
+		return
+	}
+	if viper.GetDuration("health-check-interval") <= 0 {
+		userError("--health-check-interval must be positive")
+		return
+	}
+
+	if opts.KeepaliveInterval <= 0 || opts.KeepaliveTimeout <= opts.KeepaliveInterval {
+		userError("--keepalive-timeout must be longer than a positive --keepalive-interval")
+		return
+	}
 
 	// Setup graceful shutdown
 	signals := make(chan os.Signal, 1)
@@ -178,40 +313,82 @@ func runClient(cmd *cobra.Command, args []string) {
 	}()
 
 	// logInfo("Client starting up...")
-	lastAssignedHostname := hostname
+	// The default --server is the public one; a discovery file replaces it
+	// unless --server was given as well.
+	serverList, discovery := server, viper.GetString("server-discovery")
+	if discovery != "" && !viper.IsSet("server") {
+		serverList = ""
+	}
+	servers, err := loadServers(serverList, discovery)
+	if err != nil || len(servers) == 0 {
+		userError("No usable tunnel server: %v", err)
+		return
+	}
+	servers = rankServers(servers)
+	serverIndex := 0
+	state := &tunnelState{Hostname: hostname, Server: servers[0]}
+	if check := viper.GetString("health-check"); check != "off" && len(opts.localAddrs()) > 0 {
+		// A custom offline page replaces the server's "starting up" page, so
+		// only report health when there is none.
+		state.Health = newHealthMonitor(opts.localAddrs(), check, viper.GetDuration("health-check-interval"), opts.OfflinePage == nil, opts.HTTPClient)
+		go state.Health.run()
+	}
 
-	firstAttempt := true
+	failures := 0
 	for {
 		select {
 		case <-stop:
 			return
 		default:
-			assignedHostname, err := connectAndServe(lastAssignedHostname, local, server, preserveClientIP, authToken)
-			if err != nil {
-				if firstAttempt {
-					logError("Initial connection/authentication failed: %v. Not retrying.", err)
-					return
-				}
-				if assignedHostname != "" {
-					lastAssignedHostname = assignedHostname
-				}
-				logError("Connection error: %v. Reconnecting to %s in %v...", err, lastAssignedHostname, reconnectDelay)
-				select {
-				case <-stop:
-					return
-				case <-time.After(reconnectDelay):
-				}
-			} else if assignedHostname != "" {
-				firstAttempt = false
-				lastAssignedHostname = assignedHostname
-				logInfo("Server closed connection for hostname '%s'. Reconnecting...", lastAssignedHostname)
-				select {
-				case <-stop:
-					return
-				case <-time.After(reconnectDelay):
+			state.Authenticated = false
+			err := connectAndServe(state, opts)
+			if state.wasDisconnected() {
+				// An administrator dropped the tunnel; coming back would undo that.
+				userError("Tunnel was disconnected by the server. Not reconnecting.")
+				os.Exit(1)
+			}
+			var handshakeErr *protocol.HandshakeError
+			if errors.As(err, &handshakeErr) && handshakeErr.Code == protocol.ErrHostnameDenied && state.forgetResumedHostname(hostname) {
+				// The server no longer honours the name it gave us (it
+				// restarted, we failed over, or the resume secret expired);
+				// take a fresh one rather than giving up.
+				logInfo("Server refused to resume the previous hostname: %s. Requesting a new one.", handshakeErr.Reason)
+			} else if errors.As(err, &handshakeErr) && handshakeErr.Permanent() {
+				userError("Server rejected the tunnel (%s): %s. Not retrying.", handshakeErr.Code, handshakeErr.Reason)
+				os.Exit(1)
+			}
+			if !state.Established && !retryInitial {
+				logError("Initial connection/authentication failed: %v. Not retrying.", err)
+				return
+			}
+			if state.Authenticated {
+				failures = 0
+			}
+			failures++
+			if maxRetries > 0 && failures > maxRetries {
+				userError("Giving up after %d failed attempts: %v", maxRetries, err)
+				os.Exit(1)
+			}
+			delay := backoffDelay(reconnectDelay, reconnectMaxDelay, failures)
+			if hint, ok := state.takeReconnectHint(); ok {
+				delay = hint
+			} else if !state.Authenticated && len(servers) > 1 {
+				// Fail over straight away; only back off once every server
+				// has been tried.
+				serverIndex = (serverIndex + 1) % len(servers)
+				if serverIndex == 0 {
+					servers = rankServers(servers)
+				} else {
+					delay = 0
 				}
-			} else {
-				firstAttempt = false
+				state.setServer(servers[serverIndex])
+				logInfo("Failing over to %s", servers[serverIndex])
+			}
+			logError("Connection error: %v. Reconnecting to %s in %v...", err, state.Hostname, delay)
+			select {
+			case <-stop:
+				return
+			case <-time.After(delay):
 			}
 		}
 	}
@@ -275,8 +452,107 @@ func logResponse(status int, statusText string) {
 	logSuccess("Response: %s %s", statusColor.Sprintf("%d", status), statusText)
 }
 
+// tunnelOptions holds everything needed to (re)establish a tunnel.
+type tunnelOptions struct {
+	Local             string
+	Upstreams         *upstreamPool // for requests no route matches; may be empty
+	Routes            []*route
+	Files             *fileServer           // `ngopen serve`: answers instead of Upstreams
+	HostHeader        string                // --host-header mode or literal value
+	HTTPClient        *http.Client          // reaches the local services
+	RequestHeaders    []protocol.HeaderRule // applied before forwarding locally
+	ResponseHeaders   []protocol.HeaderRule // applied before answering the server
+	Server            string
+	PreserveClientIP  bool
+	AuthToken         string
+	Domain            string
+	Pool              string
+	BasicAuth         string
+	OIDCEmails        []string
+	OIDCDomains       []string
+	AllowCIDRs        []string
+	DenyCIDRs         []string
+	KeepaliveInterval time.Duration
+	KeepaliveTimeout  time.Duration
+	OfflinePage       []byte // served instead of the server's error page when the local service is down
+}
+
+// tunnelState is what the client learns from the server and carries across
+// reconnects.
+type tunnelState struct {
+	Hostname    string // hostname to ask for; "AUTO" until one is assigned
+	Resume      string // secret proving we held Hostname before
+	Server      string // tunnel server to dial next
+	Established bool   // a connection has authenticated at least once
+	// Authenticated is set when the current connection attempt authenticated.
+	Authenticated bool
+	Health        *healthMonitor // nil when health checks are off
+
+	mu             sync.Mutex
+	reconnectDelay time.Duration // server-requested wait before reconnecting
+	hasHint        bool
+	disconnected   bool // the server sent DISCONNECT
+}
+
+// setReconnectHint records the server's request to reconnect after delay,
+// optionally to a different server.
+func (s *tunnelState) setReconnectHint(delay time.Duration, server string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reconnectDelay = delay
+	s.hasHint = true
+	if server != "" {
+		s.Server = server
+	}
+}
+
+// setDisconnected records that the server dropped the tunnel for good.
+func (s *tunnelState) setDisconnected() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.disconnected = true
+}
+
+func (s *tunnelState) wasDisconnected() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.disconnected
+}
+
+// forgetResumedHostname drops a hostname the server assigned on an earlier
+// connection, going back to what the user asked for. It reports false when
+// the current hostname is the one the user requested.
+func (s *tunnelState) forgetResumedHostname(requested string) bool {
+	if strings.EqualFold(s.Hostname, requested) {
+		return false
+	}
+	s.Hostname, s.Resume = requested, ""
+	return true
+}
+
+func (s *tunnelState) takeReconnectHint() (time.Duration, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delay, ok := s.reconnectDelay, s.hasHint
+	s.reconnectDelay, s.hasHint = 0, false
+	return delay, ok
+}
+
+func (s *tunnelState) setServer(server string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Server = server
+}
+
+func (s *tunnelState) server() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Server
+}
+
 // --- Main tunnel logic (unchanged) ---
-func connectAndServe(hostname, local, server string, preserveClientIP bool, authToken string) (string, error) {
+func connectAndServe(state *tunnelState, opts tunnelOptions) error {
+	local, server, hostname := opts.Local, state.server(), state.Hostname
 	logInfo("Connecting to server...")
 	conn, err := net.Dial("tcp", server)
 	if err != nil {
@@ -285,7 +561,7 @@ func connectAndServe(hostname, local, server string, preserveClientIP bool, auth
 		} else {
 			userError("Could not connect to server %s. Check your network and server address.", server)
 		}
-		return "", fmt.Errorf("failed to connect to server: %w", err)
+		return fmt.Errorf("failed to connect to server: %w", err)
 	}
 	defer func() {
 		logInfo("TCP connection to %s closed", server)
@@ -303,7 +579,7 @@ func connectAndServe(hostname, local, server string, preserveClientIP bool, auth
 		} else {
 			userError("Could not establish secure tunnel session.")
 		}
-		return hostname, fmt.Errorf("failed to create smux session: %w", err)
+		return fmt.Errorf("failed to create smux session: %w", err)
 	}
 	defer func() {
 		logInfo("smux session closed")
@@ -318,12 +594,20 @@ func connectAndServe(hostname, local, server string, preserveClientIP bool, auth
 		} else {
 			userError("Could not authenticate with server. Check your token.")
 		}
-		return hostname, fmt.Errorf("failed to open auth stream: %w", err)
+		return fmt.Errorf("failed to open auth stream: %w", err)
 	}
 
 	authMsg := protocol.ProtocolAuthMessage{
-		AuthToken: authToken,
-		Hostname:  hostname,
+		AuthToken:   opts.AuthToken,
+		Hostname:    hostname,
+		Domain:      opts.Domain,
+		BasicAuth:   opts.BasicAuth,
+		OIDCEmails:  opts.OIDCEmails,
+		OIDCDomains: opts.OIDCDomains,
+		AllowCIDRs:  opts.AllowCIDRs,
+		DenyCIDRs:   opts.DenyCIDRs,
+		Resume:      state.Resume,
+		Pool:        opts.Pool,
 	}
 	encoded, err := protocol.EncodeProtocolAuthMessage(authMsg)
 	if err != nil {
@@ -333,7 +617,7 @@ func connectAndServe(hostname, local, server string, preserveClientIP bool, auth
 			userError("Internal error encoding authentication message.")
 		}
 		authStream.Close()
-		return hostname, fmt.Errorf("failed to encode auth message: %w", err)
+		return fmt.Errorf("failed to encode auth message: %w", err)
 	}
 	if _, err := authStream.Write(encoded); err != nil {
 		if debugMode {
@@ -342,35 +626,28 @@ func connectAndServe(hostname, local, server string, preserveClientIP bool, auth
 			userError("Could not send authentication to server.")
 		}
 		authStream.Close()
-		return hostname, fmt.Errorf("failed to send auth message: %w", err)
+		return fmt.Errorf("failed to send auth message: %w", err)
 	}
 
-	respHeader := make([]byte, 4)
-	if _, err := io.ReadFull(authStream, respHeader); err != nil {
-		if debugMode {
-			logError("Failed to read auth response header: %v", err)
-		} else {
-			userError("No response from server during authentication.")
-		}
-		authStream.Close()
-		return hostname, fmt.Errorf("failed to read auth response header: %w", err)
-	}
-	respLen := binary.BigEndian.Uint32(respHeader)
-	respPayload := make([]byte, respLen)
-	if _, err := io.ReadFull(authStream, respPayload); err != nil {
+	resp, err := protocol.ReadAuthResponse(authStream)
+	if err != nil {
 		if debugMode {
-			logError("Failed to read auth response payload: %v", err)
+			logError("Failed to read auth response: %v", err)
 		} else {
 			userError("No response from server during authentication.")
 		}
 		authStream.Close()
-		return hostname, fmt.Errorf("failed to read auth response payload: %w", err)
+		return err
 	}
 	authStream.Close()
 
-	respStr := string(respPayload)
-	if len(respStr) >= 3 && respStr[:3] == "OK:" {
-		assignedHostname := respStr[3:]
+	if resp.OK {
+		assignedHostname := resp.Hostname
+		if opts.Files != nil {
+			local = opts.Files.dir
+		} else if local == "" {
+			local = "routes only"
+		}
 		logSuccess("Authenticated")
 		fmt.Println()
 		color.Green("✓ Tunnel established")
@@ -380,17 +657,61 @@ func connectAndServe(hostname, local, server string, preserveClientIP bool, auth
 			color.GreenString("->"),
 			local,
 		)
+		if opts.Domain != "" {
+			fmt.Printf("%s https://%s %s %s\n",
+				color.GreenString("✓ Forwarding"),
+				color.CyanString(opts.Domain),
+				color.GreenString("->"),
+				local,
+			)
+		}
+		for _, r := range opts.Routes {
+			fmt.Printf("%s %s %s %s\n",
+				color.GreenString("✓ Routing"),
+				color.CyanString(r.pattern),
+				color.GreenString("->"),
+				strings.Join(r.upstreams.Addrs(), ","),
+			)
+		}
+		if opts.BasicAuth != "" {
+			color.Green("✓ Basic auth required for visitors")
+		}
+		if len(opts.OIDCEmails) > 0 || len(opts.OIDCDomains) > 0 {
+			color.Green("✓ Login required for visitors")
+		}
 		color.Green("✓ Ready for connections")
 		// logInfo("Tunnel established and ready for connections on https://%s", assignedHostname)
-		hostname = assignedHostname
+		state.Hostname = assignedHostname
+		state.Resume = resp.Resume
+		state.Established = true
+		state.Authenticated = true
 	} else {
 		if debugMode {
-			logError("Authentication failed: %s", respStr)
+			logError("Authentication failed: %s", resp.Reason)
 		} else {
-			userError("Authentication failed: %s", respStr)
+			userError("Authentication failed: %s", resp.Reason)
 		}
-		color.Red("❌ Authentication failed: %s", respStr)
-		return hostname, fmt.Errorf("authentication failed: %s", respStr)
+		color.Red("❌ Authentication failed: %s", resp.Reason)
+		return resp.Err()
+	}
+
+	controlStream, err := session.OpenStream()
+	if err != nil {
+		if debugMode {
+			logError("Failed to open control stream: %v", err)
+		} else {
+			userError("Could not establish secure tunnel session.")
+		}
+		return fmt.Errorf("failed to open control stream: %w", err)
+	}
+	ctrl := protocol.NewControlConn(controlStream)
+	controlDone := make(chan struct{})
+	go func() {
+		runControl(session, ctrl, opts, state)
+		close(controlDone)
+	}()
+	if state.Health != nil {
+		state.Health.attach(ctrl)
 	}
 
 	for {
@@ -401,16 +722,59 @@ func connectAndServe(hostname, local, server string, preserveClientIP bool, auth
 			} else {
 				userError("Lost connection to server. Please try reconnecting.")
 			}
-			return hostname, fmt.Errorf("failed to accept stream: %w", err)
+			// Let the control stream finish handling whatever the server
+			// sent last, such as a DISCONNECT, before deciding what to do.
+			<-controlDone
+			return fmt.Errorf("failed to accept stream: %w", err)
 		}
 		// logInfo("Accepted new stream from server. Handling HTTP request...")
-		go handleStream(stream, local, preserveClientIP)
+		go handleStream(stream, opts)
 	}
 }
 
-func handleStream(stream net.Conn, local string, preserveClientIP bool) {
+// localAddrs returns every local address requests may be forwarded to.
+func (opts tunnelOptions) localAddrs() []string {
+	seen := make(map[string]bool)
+	var addrs []string
+	add := func(list []string) {
+		for _, a := range list {
+			if !seen[a] {
+				seen[a] = true
+				addrs = append(addrs, a)
+			}
+		}
+	}
+	add(opts.Upstreams.Addrs())
+	for _, r := range opts.Routes {
+		add(r.upstreams.Addrs())
+	}
+	return addrs
+}
+
+// upstreamErrorResponse tells the server why the local service could not be
+// reached. The server renders its own error page unless an offline page is
+// supplied, which is then shown to visitors instead.
+func upstreamErrorResponse(err error, offlinePage []byte) *http.Response {
+	code := protocol.ClassifyUpstreamError(err)
+	resp := &http.Response{
+		StatusCode: protocol.UpstreamErrorStatus(code),
+		Body:       http.NoBody,
+		Header:     make(http.Header),
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+	}
+	protocol.SetUpstreamError(resp.Header, code)
+	if len(offlinePage) > 0 {
+		resp.Header.Set("Content-Type", "text/html; charset=utf-8")
+		resp.Body = io.NopCloser(bytes.NewReader(offlinePage))
+		resp.ContentLength = int64(len(offlinePage))
+	}
+	return resp
+}
+
+func handleStream(stream net.Conn, opts tunnelOptions) {
 	defer func() {
-		// logInfo("Closed stream for local service %s", local)
+		// logInfo("Closed stream for local service")
 		stream.Close()
 	}()
 
@@ -434,12 +798,12 @@ func handleStream(stream net.Conn, local string, preserveClientIP bool) {
 		return
 	}
 
-	clientIP := req.Header.Get("X-Forwarded-For")
+	// The server puts the visitor first in X-Forwarded-For.
+	clientIP, _, _ := strings.Cut(req.Header.Get("X-Forwarded-For"), ",")
+	clientIP = strings.TrimSpace(clientIP)
 	remoteAddrStr := req.RemoteAddr
 	// logInfo("Handling HTTP request for %s (client IP: %s, remote: %s)", req.URL.Path, clientIP, remoteAddrStr)
 	req.RequestURI = ""
-	req.URL.Scheme = "http"
-	req.URL.Host = local
 
 	sourceIP := clientIP
 	if sourceIP == "" {
@@ -447,24 +811,86 @@ func handleStream(stream net.Conn, local string, preserveClientIP bool) {
 	}
 	logRequest(req.Method, req.URL.Path, sourceIP)
 
-	resp, err := http.DefaultClient.Do(req)
+	protocol.RemoveHopHeaders(req.Header)
+	if !opts.PreserveClientIP {
+		req.Header.Del("X-Forwarded-For")
+		req.Header.Del("Forwarded")
+	}
+
+	upstreams := opts.Upstreams
+	r := matchRoute(opts.Routes, req.URL.Path)
+	if r != nil {
+		upstreams = r.upstreams
+		if r.strip {
+			req.URL.Path = r.rewrite(req.URL.Path)
+			req.URL.RawPath = ""
+		}
+	}
+	protocol.ApplyHeaderRules(req.Header, opts.RequestHeaders)
+	if r == nil && opts.Files != nil {
+		resp := opts.Files.serve(req)
+		logResponse(resp.StatusCode, http.StatusText(resp.StatusCode))
+		protocol.ApplyHeaderRules(resp.Header, opts.ResponseHeaders)
+		protocol.RemoveUpstreamError(resp.Header)
+		writeFramedResponse(stream, resp)
+		return
+	}
+	u := upstreams.pick(nil)
+	if u == nil {
+		writeFramedResponse(stream, &http.Response{
+			StatusCode: http.StatusNotFound,
+			Body:       io.NopCloser(strings.NewReader("No route for " + req.URL.Path + "\n")),
+			Header:     http.Header{"Content-Type": {"text/plain; charset=utf-8"}},
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+		})
+		return
+	}
+	target := func(u *upstream) {
+		req.URL.Scheme, req.URL.Host = u.scheme, u.host
+		setHostHeader(req, opts.HostHeader, u)
+	}
+	target(u)
+	resp, err := opts.HTTPClient.Do(req)
+	// Nothing was sent if the connection was refused, so bodiless requests
+	// can safely try another upstream.
+	if err != nil && protocol.ClassifyUpstreamError(err) == protocol.UpstreamUnreachable && req.Body == http.NoBody {
+		if next := upstreams.pick(u); next != nil {
+			upstreams.done(u, err)
+			if debugMode {
+				logInfo("Local service %s unreachable, retrying on %s", u.addr, next.addr)
+			}
+			u = next
+			target(u)
+			resp, err = opts.HTTPClient.Do(req)
+		}
+	}
+	defer upstreams.done(u, err)
 	if err != nil {
 		if debugMode {
 			logError("Local forward failed: %v", err)
 		} else {
-			userError("Failed to forward request to your local service.")
-		}
-		resp = &http.Response{
-			StatusCode: http.StatusBadGateway,
-			Body:       io.NopCloser(strings.NewReader("Failed to forward to local service")),
-			Header:     make(http.Header),
-			ProtoMajor: 1,
-			ProtoMinor: 1,
+			userError("Failed to forward request to your local service: %v", err)
 		}
+		resp = upstreamErrorResponse(err, opts.OfflinePage)
 	} else {
 		logResponse(resp.StatusCode, http.StatusText(resp.StatusCode))
+		protocol.RemoveHopHeaders(resp.Header)
+		protocol.ApplyHeaderRules(resp.Header, opts.ResponseHeaders)
+		// Only upstreamErrorResponse may mark a response as a failure.
+		protocol.RemoveUpstreamError(resp.Header)
 	}
+	writeFramedResponse(stream, resp)
+}
 
+// writeFramedResponse sends resp back over the stream with a length prefix.
+// Bodies of known length are streamed; others are buffered to measure them.
+func writeFramedResponse(stream net.Conn, resp *http.Response) {
+	if resp.ContentLength > 0 && len(resp.TransferEncoding) == 0 &&
+		(resp.Request == nil || resp.Request.Method != http.MethodHead) {
+		writeStreamedResponse(stream, resp)
+		return
+	}
 	var buf bytes.Buffer
 	if err := resp.Write(&buf); err != nil {
 		logError("Error encoding response: %v", err)
@@ -482,3 +908,48 @@ func handleStream(stream net.Conn, local string, preserveClientIP bool) {
 	}
 	stream.SetWriteDeadline(time.Time{})
 }
+
+// writeStreamedResponse frames resp without reading its body into memory.
+// The frame length is the size of the head, written as for a HEAD request,
+// plus ContentLength.
+func writeStreamedResponse(stream net.Conn, resp *http.Response) {
+	defer resp.Body.Close()
+	head := *resp
+	head.Body = nil
+	head.Request = &http.Request{Method: http.MethodHead}
+	var buf bytes.Buffer
+	if err := head.Write(&buf); err != nil {
+		logError("Error encoding response: %v", err)
+		return
+	}
+	total := int64(buf.Len()) + resp.ContentLength
+	if total > math.MaxUint32 {
+		logError("Response of %d bytes is too large to send through the tunnel", total)
+		return
+	}
+	lengthHeader := make([]byte, 4)
+	binary.BigEndian.PutUint32(lengthHeader, uint32(total))
+
+	stream.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	if _, err := stream.Write(append(lengthHeader, buf.Bytes()...)); err != nil {
+		logError("Error sending response on stream: %v", err)
+		return
+	}
+	// The local service may take its time producing the body; only each
+	// write to the tunnel is held to the deadline.
+	if _, err := io.CopyN(deadlineWriter{stream}, resp.Body, resp.ContentLength); err != nil {
+		logError("Error sending response on stream: %v", err)
+		return
+	}
+	stream.SetWriteDeadline(time.Time{})
+}
+
+// deadlineWriter gives every write to the stream its own deadline.
+type deadlineWriter struct {
+	stream net.Conn
+}
+
+func (w deadlineWriter) Write(p []byte) (int, error) {
+	w.stream.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	return w.stream.Write(p)
+}
@@ -0,0 +1,59 @@
+package client
+
+import (
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/heysubinoy/ngopen/protocol"
+	"github.com/xtaci/smux"
+)
+
+// runControl keeps the control stream alive and tears the session down when
+// the server stops answering, so the reconnect loop kicks in.
+func runControl(session *smux.Session, ctrl *protocol.ControlConn, opts tunnelOptions, state *tunnelState) {
+	reportedRTT := false
+	err := ctrl.Run(opts.KeepaliveInterval, opts.KeepaliveTimeout, func(msg protocol.ControlMessage) {
+		if msg.Type == protocol.ControlPong {
+			if !reportedRTT {
+				reportedRTT = true
+				color.Green("✓ Latency to server: %v", ctrl.RTT().Round(time.Millisecond))
+			} else {
+				logInfo("Heartbeat RTT: %v", ctrl.RTT().Round(time.Millisecond))
+			}
+			return
+		}
+		if msg.Type == protocol.ControlReconnect {
+			state.setReconnectHint(msg.Delay, msg.Server)
+		}
+		if msg.Type == protocol.ControlDisconnect {
+			state.setDisconnected()
+		}
+		handleControlMessage(msg)
+	})
+	if err == protocol.ErrHeartbeatTimeout {
+		userError("Server stopped responding to heartbeats. Reconnecting...")
+	} else if err != nil {
+		logInfo("Control stream closed: %v", err)
+	}
+	session.Close()
+}
+
+// handleControlMessage shows messages the server sends about the tunnel.
+func handleControlMessage(msg protocol.ControlMessage) {
+	switch msg.Type {
+	case protocol.ControlQuotaExceeded:
+		color.Yellow("⚠ Server: %s. Visitors are being turned away until it resets.", msg.Reason)
+	case protocol.ControlReconnect:
+		if msg.Server != "" {
+			color.Yellow("⚠ Server: %s. Moving to %s in %v...", msg.Reason, msg.Server, msg.Delay)
+		} else {
+			color.Yellow("⚠ Server: %s. Reconnecting in %v...", msg.Reason, msg.Delay)
+		}
+	case protocol.ControlNotice:
+		color.Cyan("ℹ Server: %s", msg.Reason)
+	case protocol.ControlDisconnect:
+		color.Red("❌ Server is disconnecting this tunnel: %s", msg.Reason)
+	default:
+		logInfo("Server message (%s): %s", msg.Type, msg.Reason)
+	}
+}
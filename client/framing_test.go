@@ -0,0 +1,83 @@
+package client
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/heysubinoy/ngopen/server"
+)
+
+// TestFramedResponseRoundTrip sends responses through the client's framing
+// and reads them back with the server's, as a tunnel stream would.
+func TestFramedResponseRoundTrip(t *testing.T) {
+	large := bytes.Repeat([]byte("0123456789abcdef"), 64*1024) // 1 MiB
+	tests := []struct {
+		name     string
+		status   int
+		length   int64
+		chunked  bool
+		body     []byte
+		wantBody []byte
+	}{
+		{name: "content length", status: http.StatusOK, length: 11, body: []byte("hello world"), wantBody: []byte("hello world")},
+		{name: "large content length", status: http.StatusOK, length: int64(len(large)), body: large, wantBody: large},
+		{name: "chunked", status: http.StatusOK, length: -1, chunked: true, body: []byte("streamed in chunks"), wantBody: []byte("streamed in chunks")},
+		{name: "no content", status: http.StatusNoContent, length: 0, body: nil, wantBody: nil},
+		{name: "not found", status: http.StatusNotFound, length: 9, body: []byte("not here\n"), wantBody: []byte("not here\n")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientEnd, serverEnd := net.Pipe()
+			defer serverEnd.Close()
+
+			resp := &http.Response{
+				StatusCode:    tt.status,
+				ProtoMajor:    1,
+				ProtoMinor:    1,
+				Header:        http.Header{"Content-Type": {"text/plain"}, "X-App": {"a", "b"}},
+				ContentLength: tt.length,
+				Body:          io.NopCloser(bytes.NewReader(tt.body)),
+			}
+			if tt.chunked {
+				resp.TransferEncoding = []string{"chunked"}
+			}
+			go func() {
+				writeFramedResponse(clientEnd, resp)
+				clientEnd.Close()
+			}()
+
+			req, _ := http.NewRequest(http.MethodGet, "http://example.test/", nil)
+			got, err := server.ReadFramedResponse(serverEnd, req)
+			if err != nil {
+				t.Fatalf("ReadFramedResponse: %v", err)
+			}
+			defer got.Body.Close()
+			if got.StatusCode != tt.status {
+				t.Fatalf("status = %d, want %d", got.StatusCode, tt.status)
+			}
+			if ct := got.Header.Get("Content-Type"); ct != "text/plain" {
+				t.Fatalf("Content-Type = %q, want text/plain", ct)
+			}
+			if app := strings.Join(got.Header.Values("X-App"), ","); app != "a,b" {
+				t.Fatalf("X-App = %q, want a,b", app)
+			}
+			if tt.chunked && (len(got.TransferEncoding) == 0 || got.TransferEncoding[0] != "chunked") {
+				t.Fatalf("TransferEncoding = %v, want chunked", got.TransferEncoding)
+			}
+			if !tt.chunked && got.ContentLength != tt.length {
+				t.Fatalf("ContentLength = %d, want %d", got.ContentLength, tt.length)
+			}
+			body, err := io.ReadAll(got.Body)
+			if err != nil {
+				t.Fatalf("reading body: %v", err)
+			}
+			if !bytes.Equal(body, tt.wantBody) {
+				t.Fatalf("body = %d bytes %.40q, want %d bytes %.40q", len(body), body, len(tt.wantBody), tt.wantBody)
+			}
+		})
+	}
+}
@@ -0,0 +1,134 @@
+package client
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/heysubinoy/ngopen/protocol"
+)
+
+const healthProbeTimeout = 3 * time.Second
+
+// healthMonitor probes the local service and reports changes to the server,
+// which answers visitors itself while the service is down. It outlives
+// individual sessions, so the current state is resent after a reconnect.
+type healthMonitor struct {
+	addrs    []string
+	check    string // "tcp" or an HTTP path such as /healthz
+	interval time.Duration
+	report   bool // send health to the server
+	client   *http.Client
+
+	mu      sync.Mutex
+	known   bool
+	healthy bool
+	detail  string
+	ctrl    *protocol.ControlConn
+}
+
+func newHealthMonitor(addrs []string, check string, interval time.Duration, report bool, client *http.Client) *healthMonitor {
+	probeClient := *client
+	probeClient.Timeout = healthProbeTimeout
+	return &healthMonitor{addrs: addrs, check: check, interval: interval, report: report, client: &probeClient}
+}
+
+// probe checks the local service once. With several addresses it is up as
+// long as one of them is.
+func (h *healthMonitor) probe() error {
+	var err error
+	for _, addr := range h.addrs {
+		if err = h.probeAddr(addr); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (h *healthMonitor) probeAddr(addr string) error {
+	scheme, host := splitTarget(addr)
+	if h.check == "tcp" {
+		conn, err := net.DialTimeout("tcp", host, healthProbeTimeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+	resp, err := h.client.Get(scheme + "://" + host + h.check)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("%s returned %s", h.check, resp.Status)
+	}
+	return nil
+}
+
+// run probes the local service forever.
+func (h *healthMonitor) run() {
+	for {
+		h.update(h.probe())
+		time.Sleep(h.interval)
+	}
+}
+
+func (h *healthMonitor) update(err error) {
+	healthy := err == nil
+	detail := ""
+	if err != nil {
+		detail = err.Error()
+		// Keep just the interesting tail of errors like "dial tcp ...: connect: connection refused".
+		if i := strings.LastIndex(detail, ": "); i >= 0 {
+			detail = detail[i+2:]
+		}
+	}
+
+	h.mu.Lock()
+	changed := !h.known || h.healthy != healthy
+	h.known, h.healthy, h.detail = true, healthy, detail
+	ctrl := h.ctrl
+	h.mu.Unlock()
+	if !changed {
+		return
+	}
+
+	if healthy {
+		color.Green("✓ Local service %s is up", strings.Join(h.addrs, ", "))
+	} else {
+		color.Yellow("⚠ Local service %s is down (%s). Visitors will see a \"starting up\" page.", strings.Join(h.addrs, ", "), detail)
+	}
+	if ctrl != nil {
+		h.send(ctrl, healthy, detail)
+	}
+}
+
+// attach starts reporting to a new control stream, telling the server right
+// away if the service is already known to be down.
+func (h *healthMonitor) attach(ctrl *protocol.ControlConn) {
+	h.mu.Lock()
+	h.ctrl = ctrl
+	down := h.known && !h.healthy
+	detail := h.detail
+	h.mu.Unlock()
+	if down {
+		h.send(ctrl, false, detail)
+	}
+}
+
+func (h *healthMonitor) send(ctrl *protocol.ControlConn, healthy bool, detail string) {
+	if !h.report {
+		return
+	}
+	msg := protocol.ControlMessage{Type: protocol.ControlHealth, Status: protocol.HealthUp}
+	if !healthy {
+		msg.Status, msg.Reason = protocol.HealthDown, detail
+	}
+	if err := ctrl.Send(msg); err != nil {
+		logError("Failed to report local service health: %v", err)
+	}
+}
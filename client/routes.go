@@ -0,0 +1,96 @@
+package client
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// route sends requests whose path matches pattern to its own upstreams.
+type route struct {
+	pattern   string
+	prefix    string // subtree routes match this prefix; exact routes the whole path
+	exact     bool
+	strip     bool // remove the prefix before forwarding
+	upstreams *upstreamPool
+}
+
+// parseRoute parses a --route spec of the form PATH=TARGETS[;strip]. A PATH
+// ending in "/" or "/*" matches the whole subtree, anything else only that
+// exact path. TARGETS may list several addresses, like --local.
+func parseRoute(spec, strategy string) (*route, error) {
+	pattern, target, ok := strings.Cut(spec, "=")
+	if !ok || !strings.HasPrefix(pattern, "/") || target == "" {
+		return nil, fmt.Errorf("invalid route %q, expected PATH=TARGET[;strip]", spec)
+	}
+	r := &route{pattern: pattern}
+	if t, opt, ok := strings.Cut(target, ";"); ok {
+		if opt != "strip" {
+			return nil, fmt.Errorf("invalid route option %q in %q", opt, spec)
+		}
+		target, r.strip = t, true
+	}
+	r.upstreams = newUpstreamPool(target, strategy)
+	if len(r.upstreams.Addrs()) == 0 {
+		return nil, fmt.Errorf("route %q has no target", spec)
+	}
+	switch {
+	case strings.HasSuffix(pattern, "/*"):
+		r.prefix = strings.TrimSuffix(pattern, "*")
+	case strings.HasSuffix(pattern, "/"):
+		r.prefix = pattern
+	default:
+		r.prefix, r.exact = pattern, true
+	}
+	return r, nil
+}
+
+// parseRoutes parses every spec and orders them so the most specific route
+// is tried first: exact paths, then longer prefixes.
+func parseRoutes(specs []string, strategy string) ([]*route, error) {
+	var routes []*route
+	for _, spec := range specs {
+		r, err := parseRoute(spec, strategy)
+		if err != nil {
+			return nil, err
+		}
+		routes = append(routes, r)
+	}
+	sort.SliceStable(routes, func(i, j int) bool {
+		if routes[i].exact != routes[j].exact {
+			return routes[i].exact
+		}
+		return len(routes[i].prefix) > len(routes[j].prefix)
+	})
+	return routes, nil
+}
+
+func (r *route) matches(path string) bool {
+	if r.exact {
+		return path == r.prefix
+	}
+	// "/api/" also covers "/api" itself.
+	return strings.HasPrefix(path, r.prefix) || path == strings.TrimSuffix(r.prefix, "/")
+}
+
+// rewrite strips the route prefix from path, keeping it absolute.
+func (r *route) rewrite(path string) string {
+	if !r.strip {
+		return path
+	}
+	rest := strings.TrimPrefix(path, strings.TrimSuffix(r.prefix, "/"))
+	if !strings.HasPrefix(rest, "/") {
+		rest = "/" + rest
+	}
+	return rest
+}
+
+// matchRoute returns the first route matching path, or nil.
+func matchRoute(routes []*route, path string) *route {
+	for _, r := range routes {
+		if r.matches(path) {
+			return r
+		}
+	}
+	return nil
+}
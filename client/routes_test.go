@@ -0,0 +1,91 @@
+package client
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMatchRoute(t *testing.T) {
+	routes, err := parseRoutes([]string{
+		"/api/*=:3001",
+		"/api/v2/=:3002;strip",
+		"/health=:3003",
+		"/static/=:3004;strip",
+		"/=:3000",
+	}, upstreamRoundRobin)
+	if err != nil {
+		t.Fatalf("parseRoutes: %v", err)
+	}
+	tests := []struct {
+		path     string
+		pattern  string // "" when no route should match
+		upstream string
+		rewrite  string
+	}{
+		{path: "/api/users", pattern: "/api/*", upstream: ":3001", rewrite: "/api/users"},
+		{path: "/api", pattern: "/api/*", upstream: ":3001", rewrite: "/api"},
+		{path: "/api/v2/users", pattern: "/api/v2/", upstream: ":3002", rewrite: "/users"},
+		{path: "/api/v2", pattern: "/api/v2/", upstream: ":3002", rewrite: "/"},
+		{path: "/api/v2/", pattern: "/api/v2/", upstream: ":3002", rewrite: "/"},
+		{path: "/api/v20", pattern: "/api/*", upstream: ":3001", rewrite: "/api/v20"},
+		{path: "/apix", pattern: "/", upstream: ":3000", rewrite: "/apix"},
+		{path: "/health", pattern: "/health", upstream: ":3003", rewrite: "/health"},
+		{path: "/health/deep", pattern: "/", upstream: ":3000", rewrite: "/health/deep"},
+		{path: "/static", pattern: "/static/", upstream: ":3004", rewrite: "/"},
+		{path: "/static/css/app.css", pattern: "/static/", upstream: ":3004", rewrite: "/css/app.css"},
+		{path: "/staticfile", pattern: "/", upstream: ":3000", rewrite: "/staticfile"},
+		{path: "/", pattern: "/", upstream: ":3000", rewrite: "/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			r := matchRoute(routes, tt.path)
+			if r == nil {
+				t.Fatalf("no route matched, want %s", tt.pattern)
+			}
+			if r.pattern != tt.pattern {
+				t.Fatalf("matched %s, want %s", r.pattern, tt.pattern)
+			}
+			if addrs := r.upstreams.Addrs(); len(addrs) != 1 || addrs[0] != tt.upstream {
+				t.Fatalf("upstreams = %v, want %s", addrs, tt.upstream)
+			}
+			if got := r.rewrite(tt.path); got != tt.rewrite {
+				t.Fatalf("rewrite = %q, want %q", got, tt.rewrite)
+			}
+		})
+	}
+}
+
+func TestMatchRouteWithoutCatchAll(t *testing.T) {
+	routes, err := parseRoutes([]string{"/api/=:3001"}, upstreamRoundRobin)
+	if err != nil {
+		t.Fatalf("parseRoutes: %v", err)
+	}
+	for _, path := range []string{"/apix", "/", "/ap"} {
+		if r := matchRoute(routes, path); r != nil {
+			t.Errorf("matchRoute(%q) = %s, want no match", path, r.pattern)
+		}
+	}
+}
+
+func TestParseRouteErrors(t *testing.T) {
+	tests := []struct {
+		spec string
+		want string
+	}{
+		{spec: "/api", want: "invalid route"},
+		{spec: "api=:3001", want: "invalid route"},
+		{spec: "/api=", want: "invalid route"},
+		{spec: "=:3001", want: "invalid route"},
+		{spec: "/api=:3001;rewrite", want: "invalid route option"},
+		{spec: "/api= , ", want: "has no target"},
+		{spec: "/api=;strip", want: "has no target"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			_, err := parseRoutes([]string{"/=:3000", tt.spec}, upstreamRoundRobin)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("parseRoutes error = %v, want it to mention %q", err, tt.want)
+			}
+		})
+	}
+}
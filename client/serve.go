@@ -0,0 +1,157 @@
+package client
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// fileServer answers requests from a local directory in-process, for
+// `ngopen serve`. It lists directories, serves index.html and range requests,
+// and hides dotfiles unless asked not to.
+type fileServer struct {
+	dir string
+	http.Handler
+}
+
+func newServeCmd() *cobra.Command {
+	serveCmd := &cobra.Command{
+		Use:   "serve <dir>",
+		Short: "Share a local directory through the tunnel without running a web server",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			dir := args[0]
+			if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+				userError("%s is not a directory", dir)
+				return
+			}
+			runTunnel(cmd, newFileServer(dir, viper.GetBool("spa"), viper.GetBool("dotfiles")))
+		},
+	}
+	serveCmd.Flags().Bool("spa", false, "Serve index.html for pages that don't exist, for single-page apps")
+	serveCmd.Flags().Bool("dotfiles", false, "Also serve files and directories whose names start with a dot, such as .git and .env")
+	viper.BindPFlag("spa", serveCmd.Flags().Lookup("spa"))
+	viper.BindPFlag("dotfiles", serveCmd.Flags().Lookup("dotfiles"))
+	return serveCmd
+}
+
+func newFileServer(dir string, spa, dotfiles bool) *fileServer {
+	var root http.FileSystem = http.Dir(dir)
+	if !dotfiles {
+		root = dotfileHidingFS{root}
+	}
+	files := http.FileServer(root)
+	if !spa {
+		return &fileServer{dir: dir, Handler: files}
+	}
+	return &fileServer{dir: dir, Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Let the app route pages it doesn't have a file for, but keep 404s
+		// for missing assets.
+		f, err := root.Open(path.Clean("/" + r.URL.Path))
+		if err == nil {
+			f.Close()
+		}
+		if !errors.Is(err, fs.ErrNotExist) || !strings.Contains(r.Header.Get("Accept"), "text/html") {
+			files.ServeHTTP(w, r)
+			return
+		}
+		http.ServeFile(w, r, filepath.Join(dir, "index.html"))
+	})}
+}
+
+// serve answers req from the directory. The handler runs in the background
+// and its body is streamed through a pipe, so large files are not held in
+// memory.
+func (f *fileServer) serve(req *http.Request) *http.Response {
+	pr, pw := io.Pipe()
+	w := &pipeResponseWriter{header: make(http.Header), body: pw, ready: make(chan struct{})}
+	go func() {
+		f.ServeHTTP(w, req)
+		w.WriteHeader(http.StatusOK)
+		pw.Close()
+	}()
+	<-w.ready
+	resp := &http.Response{
+		StatusCode:    w.status,
+		Header:        w.sent,
+		Body:          pr,
+		ContentLength: -1,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Request:       req,
+	}
+	// For HEAD this is the length of the body that wasn't sent.
+	if n, err := strconv.ParseInt(w.sent.Get("Content-Length"), 10, 64); err == nil {
+		resp.ContentLength = n
+	}
+	return resp
+}
+
+// pipeResponseWriter hands a handler's status and headers over once they are
+// written, then passes its body through the pipe.
+type pipeResponseWriter struct {
+	header http.Header
+	sent   http.Header // snapshot of header at WriteHeader
+	status int
+	body   *io.PipeWriter
+	ready  chan struct{}
+}
+
+func (w *pipeResponseWriter) Header() http.Header { return w.header }
+
+func (w *pipeResponseWriter) WriteHeader(status int) {
+	if w.status != 0 {
+		return
+	}
+	w.status = status
+	w.sent = w.header.Clone()
+	close(w.ready)
+}
+
+func (w *pipeResponseWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(p)
+}
+
+// dotfileHidingFS answers as if files and directories whose names start with
+// a dot did not exist, and leaves them out of listings.
+type dotfileHidingFS struct {
+	http.FileSystem
+}
+
+func (fsys dotfileHidingFS) Open(name string) (http.File, error) {
+	for _, part := range strings.Split(name, "/") {
+		if strings.HasPrefix(part, ".") && part != "." && part != ".." {
+			return nil, fs.ErrNotExist
+		}
+	}
+	f, err := fsys.FileSystem.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return dotfileHidingFile{f}, nil
+}
+
+type dotfileHidingFile struct {
+	http.File
+}
+
+func (f dotfileHidingFile) Readdir(n int) ([]fs.FileInfo, error) {
+	entries, err := f.File.Readdir(n)
+	visible := entries[:0]
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), ".") {
+			visible = append(visible, entry)
+		}
+	}
+	return visible, err
+}
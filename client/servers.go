@@ -0,0 +1,93 @@
+package client
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+const probeTimeout = 3 * time.Second
+
+// loadServers combines the comma-separated --server list with the addresses
+// in the discovery file, if any. The file holds either a JSON array or one
+// address per line, with # comments.
+func loadServers(list, discoveryFile string) ([]string, error) {
+	var servers []string
+	for _, s := range strings.Split(list, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			servers = append(servers, s)
+		}
+	}
+	if discoveryFile == "" {
+		return servers, nil
+	}
+	data, err := os.ReadFile(discoveryFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read server discovery file: %w", err)
+	}
+	if trimmed := strings.TrimSpace(string(data)); strings.HasPrefix(trimmed, "[") {
+		var fromFile []string
+		if err := json.Unmarshal([]byte(trimmed), &fromFile); err != nil {
+			return nil, fmt.Errorf("failed to parse server discovery file: %w", err)
+		}
+		return append(fromFile, servers...), nil
+	}
+	var fromFile []string
+	scanner := bufio.NewScanner(strings.NewReader(string(data)))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fromFile = append(fromFile, line)
+	}
+	return append(fromFile, servers...), nil
+}
+
+// rankServers orders servers by TCP connect latency, unreachable ones last.
+func rankServers(servers []string) []string {
+	if len(servers) < 2 {
+		return servers
+	}
+	latency := make(map[string]time.Duration, len(servers))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, s := range servers {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			start := time.Now()
+			d := time.Duration(1<<63 - 1)
+			if conn, err := net.DialTimeout("tcp", addr, probeTimeout); err == nil {
+				d = time.Since(start)
+				conn.Close()
+			}
+			mu.Lock()
+			latency[addr] = d
+			mu.Unlock()
+		}(s)
+	}
+	wg.Wait()
+
+	ranked := append([]string(nil), servers...)
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return latency[ranked[i]] < latency[ranked[j]]
+	})
+	for _, s := range ranked {
+		if latency[s] == time.Duration(1<<63-1) {
+			logInfo("Server %s: unreachable", s)
+		} else {
+			logInfo("Server %s: %v", s, latency[s].Round(time.Millisecond))
+		}
+	}
+	color.Cyan("Using server %s", ranked[0])
+	return ranked
+}
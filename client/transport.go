@@ -0,0 +1,60 @@
+package client
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Values for --host-header other than a literal host name.
+const (
+	hostHeaderPreserve = "preserve" // pass the public hostname through
+	hostHeaderRewrite  = "rewrite"  // use the local target's host:port
+)
+
+// newLocalHTTPClient returns the client used to reach local services. Unlike
+// http.DefaultClient, which the client used before, it does not follow
+// redirects, so they reach the visitor as sent.
+func newLocalHTTPClient(insecure bool, caFile string) (*http.Client, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: insecure}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}, nil
+}
+
+// setHostHeader applies --host-header to a request bound for u.
+func setHostHeader(req *http.Request, mode string, u *upstream) {
+	switch mode {
+	case hostHeaderPreserve, "":
+	case hostHeaderRewrite:
+		req.Host = u.host
+		// --local :3000 dials localhost, so say so.
+		if strings.HasPrefix(req.Host, ":") {
+			req.Host = "localhost" + req.Host
+		}
+	default:
+		req.Host = mode
+	}
+}
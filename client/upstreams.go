@@ -0,0 +1,138 @@
+package client
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/heysubinoy/ngopen/protocol"
+)
+
+// Strategies for spreading requests over several --local addresses.
+const (
+	upstreamRoundRobin = "round-robin"
+	upstreamLeastConn  = "least-conn"
+)
+
+// An upstream that fails this many times in a row is skipped for a while.
+const (
+	upstreamMaxFails     = 2
+	upstreamEjectionTime = 10 * time.Second
+)
+
+// upstream is one local address requests can be forwarded to.
+type upstream struct {
+	addr   string // as given, e.g. ":3000" or "https://localhost:8443"
+	scheme string
+	host   string
+	active atomic.Int64 // requests currently being forwarded
+
+	// guarded by upstreamPool.mu
+	failures     int
+	ejectedUntil time.Time
+}
+
+// upstreamPool spreads requests over the --local addresses and passively
+// ejects ones that stop accepting connections.
+type upstreamPool struct {
+	strategy  string
+	upstreams []*upstream
+
+	mu   sync.Mutex
+	next int
+}
+
+// newUpstreamPool parses a comma separated list of local addresses.
+func newUpstreamPool(list, strategy string) *upstreamPool {
+	p := &upstreamPool{strategy: strategy}
+	for _, addr := range strings.Split(list, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			scheme, host := splitTarget(addr)
+			p.upstreams = append(p.upstreams, &upstream{addr: addr, scheme: scheme, host: host})
+		}
+	}
+	return p
+}
+
+// splitTarget splits a local target into scheme and host, defaulting to http.
+func splitTarget(target string) (scheme, host string) {
+	if s, h, ok := strings.Cut(target, "://"); ok {
+		return strings.ToLower(s), strings.TrimSuffix(h, "/")
+	}
+	return "http", target
+}
+
+// Addrs returns every configured address.
+func (p *upstreamPool) Addrs() []string {
+	addrs := make([]string, len(p.upstreams))
+	for i, u := range p.upstreams {
+		addrs[i] = u.addr
+	}
+	return addrs
+}
+
+// pick chooses an upstream other than skip, preferring ones that are not
+// ejected. It returns nil if skip is the only upstream. The caller must call
+// done with the result.
+func (p *upstreamPool) pick(skip *upstream) *upstream {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	var candidates, ejected []*upstream
+	for _, u := range p.upstreams {
+		if u == skip {
+			continue
+		}
+		if now.Before(u.ejectedUntil) {
+			ejected = append(ejected, u)
+		} else {
+			candidates = append(candidates, u)
+		}
+	}
+	if len(candidates) == 0 {
+		// Everything is ejected: trying one beats failing outright.
+		candidates = ejected
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	start := p.next % len(candidates)
+	p.next++
+	picked := candidates[start]
+	if p.strategy == upstreamLeastConn {
+		for i := 1; i < len(candidates); i++ {
+			u := candidates[(start+i)%len(candidates)]
+			if u.active.Load() < picked.active.Load() {
+				picked = u
+			}
+		}
+	}
+	picked.active.Add(1)
+	return picked
+}
+
+// done records the outcome of a request forwarded to u.
+func (p *upstreamPool) done(u *upstream, err error) {
+	u.active.Add(-1)
+	// Only connection failures say anything about the upstream's health.
+	failed := err != nil && protocol.ClassifyUpstreamError(err) != protocol.UpstreamFailed
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !failed {
+		if u.failures >= upstreamMaxFails && len(p.upstreams) > 1 {
+			color.Green("✓ Local service %s is back", u.addr)
+		}
+		u.failures = 0
+		u.ejectedUntil = time.Time{}
+		return
+	}
+	u.failures++
+	if u.failures == upstreamMaxFails && len(p.upstreams) > 1 {
+		color.Yellow("⚠ Local service %s is failing, sending requests elsewhere for %v", u.addr, upstreamEjectionTime)
+	}
+	if u.failures >= upstreamMaxFails {
+		u.ejectedUntil = time.Now().Add(upstreamEjectionTime)
+	}
+}
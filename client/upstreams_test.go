@@ -0,0 +1,117 @@
+package client
+
+import (
+	"net"
+	"slices"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// refused is what dialing a local service that is not listening returns.
+var refused = &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+
+func TestUpstreamPoolPick(t *testing.T) {
+	tests := []struct {
+		name     string
+		strategy string
+		addrs    string
+		setup    func(p *upstreamPool)
+		down     []string // upstreams whose requests fail
+		want     []string // picks in order
+	}{
+		{
+			name:  "round robin",
+			addrs: ":3000, :3001, :3002",
+			want:  []string{":3000", ":3001", ":3002", ":3000", ":3001"},
+		},
+		{
+			name:  "ejected after repeated failures",
+			addrs: ":3000,:3001,:3002",
+			down:  []string{":3001"},
+			// The first failure is tolerated, the second ejects it.
+			want: []string{":3000", ":3001", ":3002", ":3000", ":3001", ":3002", ":3000", ":3002", ":3000"},
+		},
+		{
+			name:  "readmitted after the cooldown",
+			addrs: ":3000,:3001",
+			setup: func(p *upstreamPool) {
+				p.upstreams[0].failures = upstreamMaxFails
+				p.upstreams[0].ejectedUntil = time.Now().Add(-time.Millisecond)
+			},
+			want: []string{":3000", ":3001", ":3000"},
+		},
+		{
+			name:  "still ejected during the cooldown",
+			addrs: ":3000,:3001",
+			setup: func(p *upstreamPool) {
+				p.upstreams[0].failures = upstreamMaxFails
+				p.upstreams[0].ejectedUntil = time.Now().Add(time.Minute)
+			},
+			want: []string{":3001", ":3001", ":3001"},
+		},
+		{
+			name:  "every upstream ejected",
+			addrs: ":3000,:3001",
+			setup: func(p *upstreamPool) {
+				for _, u := range p.upstreams {
+					u.failures = upstreamMaxFails
+					u.ejectedUntil = time.Now().Add(time.Minute)
+				}
+			},
+			down: []string{":3000", ":3001"},
+			want: []string{":3000", ":3001", ":3000", ":3001"},
+		},
+		{
+			name:     "least connections",
+			strategy: upstreamLeastConn,
+			addrs:    ":3000,:3001,:3002",
+			setup: func(p *upstreamPool) {
+				p.upstreams[0].active.Store(5)
+				p.upstreams[2].active.Store(1)
+			},
+			want: []string{":3001", ":3001", ":3001"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			strategy := tt.strategy
+			if strategy == "" {
+				strategy = upstreamRoundRobin
+			}
+			p := newUpstreamPool(tt.addrs, strategy)
+			if tt.setup != nil {
+				tt.setup(p)
+			}
+			var got []string
+			for range tt.want {
+				u := p.pick(nil)
+				if u == nil {
+					t.Fatalf("pick returned nil after %v", got)
+				}
+				got = append(got, u.addr)
+				var err error
+				if slices.Contains(tt.down, u.addr) {
+					err = refused
+				}
+				p.done(u, err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Fatalf("picks = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpstreamPoolPickSkip(t *testing.T) {
+	single := newUpstreamPool(":3000", upstreamRoundRobin)
+	if u := single.pick(single.upstreams[0]); u != nil {
+		t.Fatalf("pick skipping the only upstream = %s, want nil", u.addr)
+	}
+	pair := newUpstreamPool(":3000,:3001", upstreamRoundRobin)
+	for i := 0; i < 3; i++ {
+		if u := pair.pick(pair.upstreams[0]); u == nil || u.addr != ":3001" {
+			t.Fatalf("pick skipping :3000 = %v, want :3001", u)
+		}
+	}
+}
@@ -12,6 +12,9 @@ func main() {
 	if len(os.Args) > 1 && strings.ToLower(os.Args[1]) == "server" {
 		registry := server.NewTunnelRegistry()
 		go server.StartTunnelListener(registry)
+		go server.StartClusterListener(registry)
+		go server.StartAdminAPI(registry)
+		go server.HandleDrainSignals(registry)
 		server.StartHTTPServer(registry)
 	} else {
 		client.Main()
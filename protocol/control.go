@@ -0,0 +1,210 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Control message types exchanged on the control stream.
+const (
+	ControlPing          = "PING"
+	ControlPong          = "PONG"
+	ControlDisconnect    = "DISCONNECT"
+	ControlQuotaExceeded = "QUOTA_EXCEEDED"
+	ControlReconnect     = "RECONNECT"
+	ControlHealth        = "HEALTH"
+	ControlNotice        = "NOTICE"
+)
+
+// Health states carried by HEALTH messages.
+const (
+	HealthUp   = "UP"
+	HealthDown = "DOWN"
+)
+
+const controlWriteTimeout = 10 * time.Second
+
+// controlPrefix marks a frame as a control message rather than an HTTP request.
+const controlPrefix = "CONTROL:"
+
+// ErrHeartbeatTimeout is returned by ControlConn.Run when the peer stops
+// answering pings.
+var ErrHeartbeatTimeout = errors.New("heartbeat timeout")
+
+type ControlMessage struct {
+	Type   string
+	Reason string        // human readable explanation, shown to the user
+	Seq    int64         // ping sequence number, echoed in the pong
+	Time   int64         // ping send time in unix nanoseconds, echoed in the pong
+	Delay  time.Duration // how long to wait before reconnecting
+	Server string        // alternative server to reconnect to
+	Status string        // local service health, HealthUp or HealthDown
+}
+
+// EncodeControlMessage frames msg the same way as HTTP requests.
+func EncodeControlMessage(msg ControlMessage) []byte {
+	payload := fmt.Sprintf("%s%s\n", controlPrefix, msg.Type)
+	if msg.Reason != "" {
+		payload += fmt.Sprintf("REASON:%s\n", msg.Reason)
+	}
+	if msg.Seq != 0 || msg.Time != 0 {
+		payload += fmt.Sprintf("SEQ:%d\nTIME:%d\n", msg.Seq, msg.Time)
+	}
+	if msg.Delay != 0 {
+		payload += fmt.Sprintf("DELAY:%d\n", msg.Delay.Milliseconds())
+	}
+	if msg.Server != "" {
+		payload += fmt.Sprintf("SERVER:%s\n", msg.Server)
+	}
+	if msg.Status != "" {
+		payload += fmt.Sprintf("STATUS:%s\n", msg.Status)
+	}
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, uint32(len(payload)))
+	return append(header, []byte(payload)...)
+}
+
+func SendControlMessage(w io.Writer, msg ControlMessage) error {
+	_, err := w.Write(EncodeControlMessage(msg))
+	return err
+}
+
+// ReadControlMessage reads one framed control message from r.
+func ReadControlMessage(r io.Reader) (ControlMessage, error) {
+	payload, err := readMessage(r)
+	if err != nil {
+		return ControlMessage{}, err
+	}
+	return ParseControlMessage(payload)
+}
+
+// IsControlFrame reports whether a frame payload holds a control message.
+func IsControlFrame(payload []byte) bool {
+	return bytes.HasPrefix(payload, []byte(controlPrefix))
+}
+
+// ParseControlMessage decodes a frame payload for which IsControlFrame is true.
+func ParseControlMessage(payload []byte) (ControlMessage, error) {
+	var msg ControlMessage
+	if !IsControlFrame(payload) {
+		return msg, fmt.Errorf("not a control message")
+	}
+	for _, line := range splitLines(string(payload)) {
+		if k, v, ok := parseKeyValue(line); ok {
+			switch k {
+			case "CONTROL":
+				msg.Type = v
+			case "REASON":
+				msg.Reason = v
+			case "SEQ":
+				msg.Seq, _ = strconv.ParseInt(v, 10, 64)
+			case "TIME":
+				msg.Time, _ = strconv.ParseInt(v, 10, 64)
+			case "DELAY":
+				ms, _ := strconv.ParseInt(v, 10, 64)
+				msg.Delay = time.Duration(ms) * time.Millisecond
+			case "SERVER":
+				msg.Server = v
+			case "STATUS":
+				msg.Status = v
+			}
+		}
+	}
+	return msg, nil
+}
+
+// ControlConn is the long-lived control stream between client and server.
+// Both ends ping each other and answer pings, so either side notices a dead
+// peer even when the underlying connection looks open.
+type ControlConn struct {
+	conn     io.ReadWriteCloser
+	mu       sync.Mutex // serialises writes
+	seq      atomic.Int64
+	lastSeen atomic.Int64 // unix nanoseconds of the last message received
+	rtt      atomic.Int64
+	ponged   atomic.Bool // the peer has answered a ping
+}
+
+func NewControlConn(conn io.ReadWriteCloser) *ControlConn {
+	c := &ControlConn{conn: conn}
+	c.lastSeen.Store(time.Now().UnixNano())
+	return c
+}
+
+// Send writes msg to the peer. It is safe for concurrent use.
+func (c *ControlConn) Send(msg ControlMessage) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// A stalled peer must not block the sender forever.
+	if d, ok := c.conn.(interface{ SetWriteDeadline(time.Time) error }); ok {
+		d.SetWriteDeadline(time.Now().Add(controlWriteTimeout))
+		defer d.SetWriteDeadline(time.Time{})
+	}
+	return SendControlMessage(c.conn, msg)
+}
+
+// RTT returns the round trip time measured by the last ping, or zero.
+func (c *ControlConn) RTT() time.Duration {
+	return time.Duration(c.rtt.Load())
+}
+
+func (c *ControlConn) Close() error {
+	return c.conn.Close()
+}
+
+// Run pings the peer every interval and reads messages until the stream
+// fails or nothing has been heard for timeout. The timeout only applies once
+// the peer has answered a ping, since older peers accept the stream but never
+// reply. Pings are answered here; every other message, including pongs, is
+// passed to handle.
+func (c *ControlConn) Run(interval, timeout time.Duration, handle func(ControlMessage)) error {
+	errc := make(chan error, 1)
+	go func() {
+		for {
+			msg, err := ReadControlMessage(c.conn)
+			if err != nil {
+				errc <- err
+				return
+			}
+			now := time.Now()
+			c.lastSeen.Store(now.UnixNano())
+			switch msg.Type {
+			case ControlPing:
+				c.Send(ControlMessage{Type: ControlPong, Seq: msg.Seq, Time: msg.Time})
+				continue
+			case ControlPong:
+				c.rtt.Store(now.UnixNano() - msg.Time)
+				c.ponged.Store(true)
+			}
+			if handle != nil {
+				handle(msg)
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case err := <-errc:
+			return err
+		case now := <-ticker.C:
+			if c.ponged.Load() && now.Sub(time.Unix(0, c.lastSeen.Load())) > timeout {
+				c.conn.Close()
+				return ErrHeartbeatTimeout
+			}
+			ping := ControlMessage{Type: ControlPing, Seq: c.seq.Add(1), Time: now.UnixNano()}
+			if err := c.Send(ping); err != nil {
+				c.conn.Close()
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package protocol
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Header rule actions.
+const (
+	HeaderAdd    = "add"    // append a value, keeping existing ones
+	HeaderSet    = "set"    // replace every existing value
+	HeaderRemove = "remove" // delete the header
+)
+
+// HeaderRule changes one header on a request or response. The client and the
+// server share the syntax: "add:Name=value", "set:Name=value" or
+// "remove:Name".
+type HeaderRule struct {
+	Action string
+	Name   string
+	Value  string
+}
+
+// ParseHeaderRule parses a single rule.
+func ParseHeaderRule(spec string) (HeaderRule, error) {
+	action, rest, ok := strings.Cut(strings.TrimSpace(spec), ":")
+	if !ok {
+		return HeaderRule{}, fmt.Errorf("invalid header rule %q, expected add:Name=value, set:Name=value or remove:Name", spec)
+	}
+	rule := HeaderRule{Action: strings.ToLower(action)}
+	switch rule.Action {
+	case HeaderAdd, HeaderSet:
+		if rule.Name, rule.Value, ok = strings.Cut(rest, "="); !ok {
+			return HeaderRule{}, fmt.Errorf("invalid header rule %q, %s needs Name=value", spec, rule.Action)
+		}
+	case HeaderRemove:
+		rule.Name = rest
+	default:
+		return HeaderRule{}, fmt.Errorf("invalid header rule %q, unknown action %q", spec, action)
+	}
+	rule.Name = strings.TrimSpace(rule.Name)
+	if rule.Name == "" || strings.ContainsAny(rule.Name, " \t\r\n:") {
+		return HeaderRule{}, fmt.Errorf("invalid header name in rule %q", spec)
+	}
+	if strings.ContainsAny(rule.Value, "\r\n") {
+		return HeaderRule{}, fmt.Errorf("invalid header value in rule %q", spec)
+	}
+	return rule, nil
+}
+
+// ParseHeaderRules parses every spec, stopping at the first invalid one.
+func ParseHeaderRules(specs []string) ([]HeaderRule, error) {
+	var rules []HeaderRule
+	for _, spec := range specs {
+		rule, err := ParseHeaderRule(spec)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// ApplyHeaderRules applies rules to h in order.
+func ApplyHeaderRules(h http.Header, rules []HeaderRule) {
+	for _, rule := range rules {
+		switch rule.Action {
+		case HeaderAdd:
+			h.Add(rule.Name, rule.Value)
+		case HeaderSet:
+			h.Set(rule.Name, rule.Value)
+		case HeaderRemove:
+			h.Del(rule.Name)
+		}
+	}
+}
+
+// hopHeaders only describe a single connection and must not be forwarded.
+// The list matches net/http/httputil.ReverseProxy.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// RemoveHopHeaders deletes hop-by-hop headers from h, including any named in
+// its Connection header.
+func RemoveHopHeaders(h http.Header) {
+	for _, v := range h.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
@@ -4,17 +4,102 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"strings"
 )
 
+// MaxMessageSize bounds the auth and control frames a peer may send, so a
+// bogus length prefix cannot make the reader allocate gigabytes.
+const MaxMessageSize = 64 << 10
+
+// readMessage reads a length-prefixed auth or control frame.
+func readMessage(r io.Reader) ([]byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header)
+	if length > MaxMessageSize {
+		return nil, fmt.Errorf("message of %d bytes exceeds the %d byte limit", length, MaxMessageSize)
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
 type ProtocolAuthMessage struct {
 	AuthToken string
 	Hostname  string
+	Domain    string // optional custom domain to attach to the tunnel
+	BasicAuth string // optional "user:pass" visitors must present
+	// Visitors must log in with the server's identity provider using one of
+	// these emails or email domains.
+	OIDCEmails  []string
+	OIDCDomains []string
+	AllowCIDRs  []string // only these visitor ranges may reach the tunnel
+	DenyCIDRs   []string // these visitor ranges are always rejected
+	Resume      string   // resume secret from a previous connection, to reclaim Hostname
+	Pool        string   // join other tunnels of the same owner on Hostname, using this Pool* strategy
+}
+
+// Strategies for spreading requests over a hostname pool.
+const (
+	PoolRoundRobin    = "round-robin"
+	PoolLeastInflight = "least-inflight"
+	PoolSticky        = "sticky"
+)
+
+// ValidPoolStrategy reports whether s names a pool strategy.
+func ValidPoolStrategy(s string) bool {
+	return s == PoolRoundRobin || s == PoolLeastInflight || s == PoolSticky
 }
 
 type ProtocolAuthResponse struct {
 	OK       bool
 	Hostname string // assigned hostname if OK
+	Resume   string // secret that lets the client reclaim Hostname later
 	Reason   string // failure reason if not OK
+	Code     string // machine readable failure code if not OK, see Err*
+}
+
+// Handshake failure codes. Permanent ones will fail again on retry.
+const (
+	ErrInvalidToken     = "invalid_token"
+	ErrHostnameDenied   = "hostname_denied"
+	ErrDomainUnverified = "domain_unverified"
+	ErrBadRequest       = "bad_request"
+	ErrHostnameInUse    = "hostname_in_use"
+	ErrTooManyTunnels   = "too_many_tunnels"
+	ErrShuttingDown     = "shutting_down"
+	ErrServerError      = "server_error"
+)
+
+// HandshakeError is a rejection from the server during authentication.
+type HandshakeError struct {
+	Code   string
+	Reason string
+}
+
+func (e *HandshakeError) Error() string {
+	return "authentication failed: " + e.Reason
+}
+
+// Permanent reports whether retrying the same handshake is pointless.
+func (e *HandshakeError) Permanent() bool {
+	switch e.Code {
+	case ErrInvalidToken, ErrHostnameDenied, ErrDomainUnverified, ErrBadRequest:
+		return true
+	}
+	return false
+}
+
+// Err returns the failure as a *HandshakeError, or nil if resp is OK.
+func (resp ProtocolAuthResponse) Err() error {
+	if resp.OK {
+		return nil
+	}
+	return &HandshakeError{Code: resp.Code, Reason: resp.Reason}
 }
 
 // --- Input (from client) ---
@@ -27,8 +112,14 @@ func SendAuthResponse(w io.Writer, resp ProtocolAuthResponse) error {
 	var payload string
 	if resp.OK {
 		payload = fmt.Sprintf("OK:%s", resp.Hostname)
+		if resp.Resume != "" {
+			payload += fmt.Sprintf("\nRESUME:%s", resp.Resume)
+		}
 	} else {
 		payload = fmt.Sprintf("FAIL:%s", resp.Reason)
+		if resp.Code != "" {
+			payload += fmt.Sprintf("\nCODE:%s", resp.Code)
+		}
 	}
 	length := uint32(len(payload))
 	header := make([]byte, 4)
@@ -37,8 +128,61 @@ func SendAuthResponse(w io.Writer, resp ProtocolAuthResponse) error {
 	return err
 }
 
+// ReadAuthResponse reads the server's answer to an auth message.
+func ReadAuthResponse(r io.Reader) (ProtocolAuthResponse, error) {
+	var resp ProtocolAuthResponse
+	buf, err := readMessage(r)
+	if err != nil {
+		return resp, fmt.Errorf("failed to read auth response: %w", err)
+	}
+	for i, line := range splitLines(string(buf)) {
+		k, v, ok := parseKeyValue(line)
+		if !ok {
+			continue
+		}
+		switch {
+		case i == 0 && k == "OK":
+			resp.OK = true
+			resp.Hostname = v
+		case i == 0 && k == "FAIL":
+			resp.Reason = v
+		case i == 0:
+			return resp, fmt.Errorf("unexpected auth response %q", line)
+		case k == "RESUME":
+			resp.Resume = v
+		case k == "CODE":
+			resp.Code = v
+		}
+	}
+	return resp, nil
+}
+
 func EncodeProtocolAuthMessage(msg ProtocolAuthMessage) ([]byte, error) {
 	payload := fmt.Sprintf("AUTHTOKEN:%s\nHOSTNAME:%s\n", msg.AuthToken, msg.Hostname)
+	if msg.Domain != "" {
+		payload += fmt.Sprintf("DOMAIN:%s\n", msg.Domain)
+	}
+	if msg.BasicAuth != "" {
+		payload += fmt.Sprintf("BASICAUTH:%s\n", msg.BasicAuth)
+	}
+	if len(msg.OIDCEmails) > 0 {
+		payload += fmt.Sprintf("OIDCEMAILS:%s\n", strings.Join(msg.OIDCEmails, ","))
+	}
+	if len(msg.OIDCDomains) > 0 {
+		payload += fmt.Sprintf("OIDCDOMAINS:%s\n", strings.Join(msg.OIDCDomains, ","))
+	}
+	if len(msg.AllowCIDRs) > 0 {
+		payload += fmt.Sprintf("ALLOWCIDR:%s\n", strings.Join(msg.AllowCIDRs, ","))
+	}
+	if len(msg.DenyCIDRs) > 0 {
+		payload += fmt.Sprintf("DENYCIDR:%s\n", strings.Join(msg.DenyCIDRs, ","))
+	}
+	if msg.Resume != "" {
+		payload += fmt.Sprintf("RESUME:%s\n", msg.Resume)
+	}
+	if msg.Pool != "" {
+		payload += fmt.Sprintf("POOL:%s\n", msg.Pool)
+	}
 	length := uint32(len(payload))
 	header := make([]byte, 4)
 	binary.BigEndian.PutUint32(header, length)
@@ -47,14 +191,9 @@ func EncodeProtocolAuthMessage(msg ProtocolAuthMessage) ([]byte, error) {
 
 func DecodeProtocolAuthMessage(r io.Reader) (ProtocolAuthMessage, error) {
 	var msg ProtocolAuthMessage
-	header := make([]byte, 4)
-	if _, err := io.ReadFull(r, header); err != nil {
-		return msg, fmt.Errorf("failed to read auth header: %w", err)
-	}
-	length := binary.BigEndian.Uint32(header)
-	buf := make([]byte, length)
-	if _, err := io.ReadFull(r, buf); err != nil {
-		return msg, fmt.Errorf("failed to read auth payload: %w", err)
+	buf, err := readMessage(r)
+	if err != nil {
+		return msg, fmt.Errorf("failed to read auth message: %w", err)
 	}
 	lines := string(buf)
 	for _, line := range splitLines(lines) {
@@ -67,6 +206,22 @@ func DecodeProtocolAuthMessage(r io.Reader) (ProtocolAuthMessage, error) {
 				msg.AuthToken = v
 			case "HOSTNAME":
 				msg.Hostname = v
+			case "DOMAIN":
+				msg.Domain = v
+			case "BASICAUTH":
+				msg.BasicAuth = v
+			case "OIDCEMAILS":
+				msg.OIDCEmails = splitList(v)
+			case "OIDCDOMAINS":
+				msg.OIDCDomains = splitList(v)
+			case "ALLOWCIDR":
+				msg.AllowCIDRs = splitList(v)
+			case "DENYCIDR":
+				msg.DenyCIDRs = splitList(v)
+			case "RESUME":
+				msg.Resume = v
+			case "POOL":
+				msg.Pool = v
 			}
 		}
 	}
@@ -96,3 +251,13 @@ func parseKeyValue(line string) (string, string, bool) {
 	}
 	return "", "", false
 }
+
+func splitList(s string) []string {
+	var out []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
@@ -0,0 +1,67 @@
+package protocol
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"syscall"
+)
+
+// A client that cannot reach its local service still answers the framed
+// request, but marks the response with this header so the server can tell
+// the failure apart from a broken tunnel. Only the error code is sent: the
+// underlying error names local addresses that visitors must not see.
+const UpstreamErrorHeader = "X-Ngopen-Error"
+
+// UpstreamErrorDetailHeader carried the local error text from older clients.
+// It is still removed, never shown.
+const UpstreamErrorDetailHeader = "X-Ngopen-Error-Detail"
+
+// Upstream error codes.
+const (
+	UpstreamUnreachable = "local_service_down" // nothing is listening, or the dial failed
+	UpstreamTimeout     = "local_timeout"      // the local service did not answer in time
+	UpstreamFailed      = "local_error"        // any other forwarding failure
+)
+
+// ClassifyUpstreamError maps an error from forwarding to the local service
+// to an upstream error code.
+func ClassifyUpstreamError(err error) string {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return UpstreamTimeout
+	}
+	var opErr *net.OpError
+	if errors.Is(err, syscall.ECONNREFUSED) || (errors.As(err, &opErr) && opErr.Op == "dial") {
+		return UpstreamUnreachable
+	}
+	return UpstreamFailed
+}
+
+// UpstreamErrorStatus is the HTTP status visitors see for an upstream error.
+func UpstreamErrorStatus(code string) int {
+	if code == UpstreamTimeout {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+// SetUpstreamError marks h as describing a failed forward.
+func SetUpstreamError(h http.Header, code string) {
+	h.Set(UpstreamErrorHeader, code)
+}
+
+// RemoveUpstreamError strips the upstream error headers from h, so a local
+// service cannot pass its response off as a forwarding failure.
+func RemoveUpstreamError(h http.Header) {
+	h.Del(UpstreamErrorHeader)
+	h.Del(UpstreamErrorDetailHeader)
+}
+
+// TakeUpstreamError returns the upstream error code carried by h, if any,
+// and removes the headers so they never reach visitors.
+func TakeUpstreamError(h http.Header) (code string, ok bool) {
+	code = h.Get(UpstreamErrorHeader)
+	RemoveUpstreamError(h)
+	return code, code != ""
+}
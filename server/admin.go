@@ -0,0 +1,168 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// The admin API is only started when NGOPEN_ADMIN_ADDR is set, and every
+// request must carry NGOPEN_ADMIN_TOKEN as a bearer token.
+var (
+	adminAddr  = os.Getenv("NGOPEN_ADMIN_ADDR")
+	adminToken = os.Getenv("NGOPEN_ADMIN_TOKEN")
+
+	// adminStopping is closed when the admin server shuts down so event
+	// streams end instead of holding up the drain.
+	adminStopping = make(chan struct{})
+)
+
+// tunnelInfo is the admin API view of a connected tunnel.
+type tunnelInfo struct {
+	Hostname    string    `json:"hostname"`
+	UserID      string    `json:"userId"`
+	Domain      string    `json:"domain,omitempty"`
+	RemoteAddr  string    `json:"remoteAddr"`
+	ConnectedAt time.Time `json:"connectedAt"`
+	Inflight    int64     `json:"inflight"`
+	Healthy     bool      `json:"healthy"`
+	RTT         string    `json:"rtt,omitempty"`
+}
+
+func describeTunnel(c *Client) tunnelInfo {
+	info := tunnelInfo{
+		Hostname:    c.Name,
+		UserID:      c.UserID,
+		Domain:      c.Domain,
+		RemoteAddr:  c.RemoteAddr,
+		ConnectedAt: c.ConnectedAt,
+		Inflight:    c.Inflight(),
+		Healthy:     c.Healthy(),
+	}
+	if c.Control != nil {
+		if rtt := c.Control.RTT(); rtt > 0 {
+			info.RTT = rtt.String()
+		}
+	}
+	return info
+}
+
+func adminAuthorized(r *http.Request) bool {
+	got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(got), []byte(adminToken)) == 1
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func adminHandler(registry *TunnelRegistry) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/tunnels", func(w http.ResponseWriter, r *http.Request) {
+		tunnels := []tunnelInfo{}
+		for _, c := range registry.List() {
+			tunnels = append(tunnels, describeTunnel(c))
+		}
+		writeJSON(w, http.StatusOK, tunnels)
+	})
+	mux.HandleFunc("DELETE /api/tunnels/{hostname}", func(w http.ResponseWriter, r *http.Request) {
+		members := registry.Members(qualifyHostname(r.PathValue("hostname")))
+		if len(members) == 0 {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "tunnel not found"})
+			return
+		}
+		reason := r.URL.Query().Get("reason")
+		if reason == "" {
+			reason = "disconnected by an administrator"
+		}
+		for _, client := range members {
+			LogInfo("Admin kicked tunnel '%s': %s", client.Name, reason)
+			audit.Record(AuditEntry{
+				Action:     AuditAdminKick,
+				Actor:      "admin",
+				RemoteAddr: r.RemoteAddr,
+				Hostname:   client.Name,
+				Success:    true,
+				Reason:     reason,
+				Details:    map[string]string{"owner": client.UserID},
+			})
+			// A kick is final: the client must not come straight back with
+			// its resume secret.
+			revokeResume(client.Name, client.UserID)
+			client.Disconnect(reason)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("GET /api/events", serveEventStream)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !adminAuthorized(r) {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// serveEventStream streams events as Server-Sent Events until the client
+// goes away, with a comment line every 15s to keep proxies from timing out.
+func serveEventStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	ch := events.Subscribe()
+	defer events.Unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(15 * time.Second)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-adminStopping:
+			return
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case e := <-ch:
+			data, _ := json.Marshal(e)
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data)
+		}
+		flusher.Flush()
+	}
+}
+
+// StartAdminAPI serves the admin API on NGOPEN_ADMIN_ADDR. It does nothing
+// when the address is unset.
+func StartAdminAPI(registry *TunnelRegistry) {
+	if adminAddr == "" {
+		return
+	}
+	if adminToken == "" {
+		LogError("NGOPEN_ADMIN_TOKEN must be set to enable the admin API")
+		return
+	}
+	serve := &http.Server{
+		Addr:           adminAddr,
+		Handler:        adminHandler(registry),
+		ReadTimeout:    30 * time.Second,
+		MaxHeaderBytes: 1 << 20,
+	}
+	serve.RegisterOnShutdown(func() { close(adminStopping) })
+	trackServer(serve)
+	LogInfo("Admin API listening on %s", adminAddr)
+	if err := serveUntilDrained(serve.ListenAndServe); err != nil {
+		LogError("Admin API error: %v", err)
+	}
+}
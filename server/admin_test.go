@@ -0,0 +1,59 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/xtaci/smux"
+)
+
+func TestKickedTunnelCannotResume(t *testing.T) {
+	saved, savedToken := store, adminToken
+	store, _ = NewFileStore("")
+	adminToken = "admin-secret"
+	t.Cleanup(func() { store, adminToken = saved, savedToken })
+
+	serverConn, clientConn := net.Pipe()
+	session, err := smux.Server(serverConn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := smux.Client(clientConn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	hostname := "fancy-orca-5791" + hostnameSuffix
+	registry := NewTunnelRegistry()
+	client := &Client{ID: "c1", Name: hostname, UserID: "u1", Session: session}
+	if err := registry.Add(hostname, client); err != nil {
+		t.Fatal(err)
+	}
+	resume := issueResumeSecret(hostname, "u1")
+	if !checkResumeSecret(resume, hostname, "u1") {
+		t.Fatal("fresh resume secret rejected")
+	}
+
+	req := httptest.NewRequest(http.MethodDelete, "/api/tunnels/"+hostname, nil)
+	req.Header.Set("Authorization", "Bearer admin-secret")
+	rec := httptest.NewRecorder()
+	adminHandler(registry).ServeHTTP(rec, req)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("DELETE status = %d, want %d", rec.Code, http.StatusNoContent)
+	}
+	if !session.IsClosed() {
+		t.Fatal("kicked tunnel's session is still open")
+	}
+	if checkResumeSecret(resume, hostname, "u1") {
+		t.Fatal("kicked tunnel can still resume its hostname")
+	}
+	if mayUseHostname(hostname, "u1") {
+		t.Fatal("kicked tunnel can still claim its generated hostname")
+	}
+	if reissued := issueResumeSecret(hostname, "u1"); !checkResumeSecret(reissued, hostname, "u1") {
+		t.Fatal("a newly issued secret does not work after the kick")
+	}
+}
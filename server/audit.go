@@ -0,0 +1,199 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Audit actions.
+const (
+	AuditAuthAttempt      = "auth.attempt"
+	AuditHostnameAssigned = "hostname.assigned"
+	AuditAdminKick        = "admin.kick"
+	AuditConfigLoaded     = "config.loaded"
+	AuditConfigChanged    = "config.changed"
+	AuditDrain            = "server.drain"
+)
+
+// AuditEntry is one line of the audit log.
+type AuditEntry struct {
+	Time       time.Time         `json:"time"`
+	Action     string            `json:"action"`
+	Actor      string            `json:"actor"`                // user ID, "anonymous", "admin" or "system"
+	RemoteAddr string            `json:"remoteAddr,omitempty"` // where the action came from
+	Token      string            `json:"token,omitempty"`      // token fingerprint, never the token
+	Hostname   string            `json:"hostname,omitempty"`
+	Success    bool              `json:"success"`
+	Reason     string            `json:"reason,omitempty"`
+	Details    map[string]string `json:"details,omitempty"`
+}
+
+// AuditLog appends JSON lines to a file, rotating it to path.1, path.2, …
+// once it grows past maxSize. A nil AuditLog discards everything.
+type AuditLog struct {
+	sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+}
+
+var audit = openAuditLogFromEnv()
+
+func openAuditLogFromEnv() *AuditLog {
+	path := os.Getenv("NGOPEN_AUDIT_LOG")
+	if path == "" {
+		return nil
+	}
+	a, err := NewAuditLog(path, int64(envInt("NGOPEN_AUDIT_MAX_SIZE_MB", 100))<<20, envInt("NGOPEN_AUDIT_MAX_FILES", 10))
+	if err != nil {
+		LogError("Failed to open audit log %s: %v", path, err)
+		return nil
+	}
+	return a
+}
+
+func NewAuditLog(path string, maxSize int64, maxFiles int) (*AuditLog, error) {
+	a := &AuditLog{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *AuditLog) open() error {
+	f, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	a.file, a.size = f, info.Size()
+	return nil
+}
+
+// rotate shifts path.N to path.N+1, dropping the oldest, and starts a fresh
+// file. Callers must hold the lock.
+func (a *AuditLog) rotate() error {
+	a.file.Close()
+	for i := a.maxFiles - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", a.path, i), fmt.Sprintf("%s.%d", a.path, i+1))
+	}
+	if a.maxFiles > 0 {
+		os.Rename(a.path, a.path+".1")
+	} else {
+		os.Remove(a.path)
+	}
+	return a.open()
+}
+
+// Record appends e, stamping its time if unset.
+func (a *AuditLog) Record(e AuditEntry) {
+	if a == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(e); err != nil {
+		return
+	}
+	line := buf.Bytes()
+
+	a.Lock()
+	defer a.Unlock()
+	if a.file == nil {
+		return
+	}
+	if a.maxSize > 0 && a.size > 0 && a.size+int64(len(line)) > a.maxSize {
+		if err := a.rotate(); err != nil {
+			LogError("Failed to rotate audit log: %v", err)
+			a.file = nil
+			return
+		}
+	}
+	n, err := a.file.Write(line)
+	a.size += int64(n)
+	if err != nil {
+		LogError("Failed to write audit log: %v", err)
+	}
+}
+
+// configSnapshot returns the server's NGOPEN_* settings with secrets masked.
+func configSnapshot() map[string]string {
+	config := make(map[string]string)
+	for _, kv := range os.Environ() {
+		name, value, _ := strings.Cut(kv, "=")
+		if !strings.HasPrefix(name, "NGOPEN_") && name != "API_VALIDATE_URL" {
+			continue
+		}
+		if strings.Contains(name, "SECRET") || strings.Contains(name, "TOKEN") {
+			value = "<redacted>"
+		}
+		config[name] = value
+	}
+	return config
+}
+
+// lastConfig returns the configuration recorded by the most recent startup
+// in the current log file.
+func (a *AuditLog) lastConfig() map[string]string {
+	f, err := os.Open(a.path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var last map[string]string
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for scanner.Scan() {
+		if !strings.Contains(scanner.Text(), `"action":"`+AuditConfigLoaded+`"`) {
+			continue
+		}
+		var e AuditEntry
+		if json.Unmarshal(scanner.Bytes(), &e) == nil {
+			last = e.Details
+		}
+	}
+	return last
+}
+
+// auditStartup records the configuration the server started with, plus a
+// config.changed entry listing what differs from the previous start.
+func auditStartup() {
+	if audit == nil {
+		return
+	}
+	config := configSnapshot()
+	if previous := audit.lastConfig(); previous != nil {
+		changes := make(map[string]string)
+		for name, value := range config {
+			if old, ok := previous[name]; !ok || old != value {
+				changes[name] = fmt.Sprintf("%q -> %q", old, value)
+			}
+		}
+		for name, old := range previous {
+			if _, ok := config[name]; !ok {
+				changes[name] = fmt.Sprintf("%q -> unset", old)
+			}
+		}
+		if len(changes) > 0 {
+			audit.Record(AuditEntry{Action: AuditConfigChanged, Actor: "system", Success: true, Details: changes})
+		}
+	}
+	audit.Record(AuditEntry{Action: AuditConfigLoaded, Actor: "system", Success: true, Details: config})
+	LogInfo("Audit log enabled at %s", audit.path)
+}
@@ -0,0 +1,277 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Bandwidth shaping (bytes per second) and transfer quotas (bytes). A zero
+// value disables that limit.
+var (
+	tunnelBandwidth = NewRateLimiter(envFloat("NGOPEN_BANDWIDTH_TUNNEL", 0), 0)
+	tokenBandwidth  = NewRateLimiter(envFloat("NGOPEN_BANDWIDTH_TOKEN", 0), 0)
+	quotas          = NewQuotaTracker(int64(envFloat("NGOPEN_QUOTA_DAILY", 0)), int64(envFloat("NGOPEN_QUOTA_MONTHLY", 0)), store)
+)
+
+// quotaSaveInterval bounds how often quota usage is written to the store;
+// at most this much traffic is forgotten if the server crashes.
+const quotaSaveInterval = 10 * time.Second
+
+const shapeChunk = 32 * 1024
+
+// chunkTimeout bounds each shaped chunk instead of the whole transfer, so a
+// throttled body is not cut off by the server's Read/WriteTimeout.
+const chunkTimeout = 30 * time.Second
+
+// shapedWriter throttles writes through the tunnel and token bandwidth
+// limits and counts the bytes that went through.
+type shapedWriter struct {
+	w       io.Writer
+	rc      *http.ResponseController // moves the write deadline; may be nil
+	client  *Client
+	written int64
+}
+
+func (s *shapedWriter) Write(p []byte) (int, error) {
+	total := 0
+	for len(p) > 0 {
+		chunk := shapedChunk(len(p))
+		throttle(s.client, chunk)
+		if s.rc != nil {
+			s.rc.SetWriteDeadline(time.Now().Add(chunkTimeout))
+		}
+		n, err := s.w.Write(p[:chunk])
+		total += n
+		s.written += int64(n)
+		if err != nil {
+			return total, err
+		}
+		p = p[n:]
+	}
+	return total, nil
+}
+
+// shapedReader does the same for request bodies, so uploads are throttled
+// and counted whether or not they declare a Content-Length.
+type shapedReader struct {
+	r      io.ReadCloser
+	rc     *http.ResponseController // moves the read deadline; may be nil
+	client *Client
+	read   int64
+}
+
+func (s *shapedReader) Read(p []byte) (int, error) {
+	if s.rc != nil {
+		s.rc.SetReadDeadline(time.Now().Add(chunkTimeout))
+	}
+	n, err := s.r.Read(p[:shapedChunk(len(p))])
+	if n > 0 {
+		throttle(s.client, n)
+		s.read += int64(n)
+	}
+	return n, err
+}
+
+func (s *shapedReader) Close() error {
+	return s.r.Close()
+}
+
+// shapedChunk caps n to what may go through the bandwidth limits at once.
+func shapedChunk(n int) int {
+	if n > shapeChunk {
+		n = shapeChunk
+	}
+	n = bandwidthChunk(tunnelBandwidth, n)
+	return bandwidthChunk(tokenBandwidth, n)
+}
+
+// throttle blocks until n bytes for c fit in the bandwidth limits.
+func throttle(c *Client, n int) {
+	waitBandwidth(tunnelBandwidth, c.Name, n)
+	waitBandwidth(tokenBandwidth, c.TokenHash, n)
+}
+
+// bandwidthChunk shrinks n so it fits in one bucket of l.
+func bandwidthChunk(l *RateLimiter, n int) int {
+	if l.rate > 0 && float64(n) > l.burst {
+		return int(l.burst)
+	}
+	return n
+}
+
+// waitBandwidth blocks until n bytes may be sent under l.
+func waitBandwidth(l *RateLimiter, key string, n int) {
+	if l.rate <= 0 {
+		return
+	}
+	for {
+		ok, wait := l.AllowN(key, float64(n))
+		if ok {
+			return
+		}
+		time.Sleep(wait)
+	}
+}
+
+type quotaUsage struct {
+	day        string
+	dayBytes   int64
+	month      string
+	monthBytes int64
+	notified   bool // client was told its quota ran out this period
+}
+
+// QuotaTracker counts transferred bytes per user against daily and monthly
+// quotas. Usage is saved to a Store so restarts do not reset it.
+type QuotaTracker struct {
+	sync.Mutex
+	daily    int64
+	monthly  int64
+	usage    map[string]*quotaUsage
+	store    Store            // nil keeps usage in memory only
+	saved    map[string]int64 // usage loaded at startup, by quotaUsageKey
+	lastSave time.Time
+}
+
+func NewQuotaTracker(daily, monthly int64, store Store) *QuotaTracker {
+	q := &QuotaTracker{
+		daily:   daily,
+		monthly: monthly,
+		usage:   make(map[string]*quotaUsage),
+		store:   store,
+	}
+	if store != nil && (daily > 0 || monthly > 0) {
+		q.saved = store.QuotaUsage()
+	}
+	return q
+}
+
+// quotaUsageKey names the counter for user in a period such as "2026-10"
+// or "2026-10-18".
+func quotaUsageKey(period, user string) string {
+	return period + "/" + user
+}
+
+// current returns the usage for user, resetting periods that have rolled over.
+// Callers must hold the lock.
+func (q *QuotaTracker) current(user string) *quotaUsage {
+	now := time.Now().UTC()
+	day, month := now.Format("2006-01-02"), now.Format("2006-01")
+	u, ok := q.usage[user]
+	if !ok {
+		u = &quotaUsage{
+			day:        day,
+			dayBytes:   q.saved[quotaUsageKey(day, user)],
+			month:      month,
+			monthBytes: q.saved[quotaUsageKey(month, user)],
+		}
+		q.usage[user] = u
+	}
+	if u.day != day {
+		u.day, u.dayBytes, u.notified = day, 0, false
+	}
+	if u.month != month {
+		u.month, u.monthBytes, u.notified = month, 0, false
+	}
+	return u
+}
+
+// Exceeded returns a reason if user has used up a quota.
+func (q *QuotaTracker) Exceeded(user string) (string, bool) {
+	if q.daily <= 0 && q.monthly <= 0 {
+		return "", false
+	}
+	q.Lock()
+	defer q.Unlock()
+	u := q.current(user)
+	if q.monthly > 0 && u.monthBytes >= q.monthly {
+		return "monthly transfer quota exceeded", true
+	}
+	if q.daily > 0 && u.dayBytes >= q.daily {
+		return "daily transfer quota exceeded", true
+	}
+	return "", false
+}
+
+// Add records n transferred bytes for user.
+func (q *QuotaTracker) Add(user string, n int64) {
+	if q.daily <= 0 && q.monthly <= 0 {
+		return
+	}
+	q.Lock()
+	u := q.current(user)
+	u.dayBytes += n
+	u.monthBytes += n
+	var snapshot map[string]int64
+	if q.store != nil && time.Since(q.lastSave) >= quotaSaveInterval {
+		snapshot = q.snapshot()
+	}
+	q.Unlock()
+	// Written outside the lock so store I/O does not hold up requests.
+	if snapshot != nil {
+		q.save(snapshot)
+	}
+}
+
+// Flush saves usage now, for a server about to stop.
+func (q *QuotaTracker) Flush() {
+	if q.store == nil || (q.daily <= 0 && q.monthly <= 0) {
+		return
+	}
+	q.Lock()
+	snapshot := q.snapshot()
+	q.Unlock()
+	q.save(snapshot)
+}
+
+// snapshot returns the counters of the current periods and marks them as
+// saved. Callers must hold the lock.
+func (q *QuotaTracker) snapshot() map[string]int64 {
+	q.lastSave = time.Now()
+	usage := make(map[string]int64, 2*len(q.usage))
+	for user := range q.usage {
+		u := q.current(user)
+		usage[quotaUsageKey(u.day, user)] = u.dayBytes
+		usage[quotaUsageKey(u.month, user)] = u.monthBytes
+	}
+	// Users not seen since startup keep what was loaded for this period.
+	now := time.Now().UTC()
+	for _, period := range []string{now.Format("2006-01-02"), now.Format("2006-01")} {
+		for key, n := range q.saved {
+			if _, seen := usage[key]; !seen && strings.HasPrefix(key, period+"/") {
+				usage[key] = n
+			}
+		}
+	}
+	return usage
+}
+
+func (q *QuotaTracker) save(usage map[string]int64) {
+	if err := q.store.SaveQuotaUsage(usage); err != nil {
+		LogError("Failed to save quota usage: %v", err)
+	}
+}
+
+// ShouldNotify reports whether the user still needs to be told about an
+// exhausted quota, and marks them as told.
+func (q *QuotaTracker) ShouldNotify(user string) bool {
+	q.Lock()
+	defer q.Unlock()
+	u := q.current(user)
+	if u.notified {
+		return false
+	}
+	u.notified = true
+	return true
+}
+
+// quotaKey is the identity quotas are tracked under.
+func quotaKey(c *Client) string {
+	if c.UserID != "" {
+		return c.UserID
+	}
+	return c.TokenHash
+}
@@ -0,0 +1,39 @@
+package server
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestQuotaUsageSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.json")
+	s, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := NewQuotaTracker(0, 1000, s)
+	q.Add("u1", 600)
+	q.Add("u1", 500)
+	q.Add("u2", 10)
+	q.Flush()
+	if _, exceeded := q.Exceeded("u1"); !exceeded {
+		t.Fatal("u1 is not over its quota")
+	}
+
+	// A new process opens the same store.
+	s, err = NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q = NewQuotaTracker(0, 1000, s)
+	if reason, exceeded := q.Exceeded("u1"); !exceeded || reason != "monthly transfer quota exceeded" {
+		t.Fatalf("after restart Exceeded(u1) = %q, %v; want monthly quota exceeded", reason, exceeded)
+	}
+	if _, exceeded := q.Exceeded("u2"); exceeded {
+		t.Fatal("u2 is over its quota after restart")
+	}
+	q.Add("u2", 995)
+	if _, exceeded := q.Exceeded("u2"); !exceeded {
+		t.Fatal("u2's usage from before the restart was lost")
+	}
+}
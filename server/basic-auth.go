@@ -0,0 +1,25 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// checkBasicAuth reports whether r carries the "user:pass" credentials. Both
+// sides are hashed first so the comparison does not leak their lengths.
+func checkBasicAuth(r *http.Request, credentials string) bool {
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	wantUser, wantPass, _ := strings.Cut(credentials, ":")
+	gotUserHash := sha256.Sum256([]byte(user))
+	gotPassHash := sha256.Sum256([]byte(pass))
+	wantUserHash := sha256.Sum256([]byte(wantUser))
+	wantPassHash := sha256.Sum256([]byte(wantPass))
+	userMatch := subtle.ConstantTimeCompare(gotUserHash[:], wantUserHash[:]) == 1
+	passMatch := subtle.ConstantTimeCompare(gotPassHash[:], wantPassHash[:]) == 1
+	return userMatch && passMatch
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// trustedProxies are the peers whose X-Forwarded-For entries we believe,
+// configured with NGOPEN_TRUSTED_PROXIES as a comma-separated CIDR list.
+var trustedProxies = parseTrustedProxies(os.Getenv("NGOPEN_TRUSTED_PROXIES"))
+
+func parseTrustedProxies(list string) []*net.IPNet {
+	nets, err := ParseCIDRList(strings.Split(list, ","))
+	if err != nil {
+		LogError("Invalid NGOPEN_TRUSTED_PROXIES: %v", err)
+	}
+	return nets
+}
+
+// ParseCIDRList parses CIDRs, also accepting bare IPs as single-host ranges.
+func ParseCIDRList(items []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, item := range items {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nets, &net.ParseError{Type: "IP address", Text: item}
+			}
+			bits := 32
+			if ip.To4() == nil {
+				bits = 128
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(item)
+		if err != nil {
+			return nets, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func remoteIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// trustedPeer reports whether r came straight from a trusted proxy or a
+// cluster peer, whose forwarding headers we believe.
+func trustedPeer(r *http.Request) bool {
+	ip := remoteIP(r)
+	return ip != nil && containsIP(trustedProxies, ip) || fromClusterPeer(r)
+}
+
+// forwardedFor returns the chain of addresses we vouch for, ending with the
+// peer that connected to us. X-Forwarded-For entries are only followed
+// through trusted proxies and cluster peers, walking from the nearest hop
+// outwards, so the first address is the visitor.
+func forwardedFor(r *http.Request) []net.IP {
+	ip := remoteIP(r)
+	if ip == nil {
+		return nil
+	}
+	chain := []net.IP{ip}
+	if !trustedPeer(r) {
+		return chain
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		chain = append([]net.IP{hop}, chain...)
+		if !containsIP(trustedProxies, hop) {
+			break
+		}
+	}
+	return chain
+}
+
+// clientIP returns the address of the visitor.
+func clientIP(r *http.Request) net.IP {
+	chain := forwardedFor(r)
+	if len(chain) == 0 {
+		return nil
+	}
+	return chain[0]
+}
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestForwardedFor(t *testing.T) {
+	saved := trustedProxies
+	trustedProxies = parseTrustedProxies("10.0.0.0/24, 2001:db8::1")
+	t.Cleanup(func() { trustedProxies = saved })
+
+	tests := []struct {
+		name   string
+		remote string
+		xff    []string // one X-Forwarded-For header per entry
+		want   string   // comma-separated chain, visitor first
+	}{
+		{name: "direct visitor", remote: "203.0.113.7:5000", want: "203.0.113.7"},
+		{name: "untrusted peer spoofing", remote: "203.0.113.7:5000", xff: []string{"198.51.100.1"}, want: "203.0.113.7"},
+		{name: "trusted proxy", remote: "10.0.0.1:5000", xff: []string{"203.0.113.7"}, want: "203.0.113.7,10.0.0.1"},
+		{name: "visitor-supplied entry is ignored", remote: "10.0.0.1:5000", xff: []string{"198.51.100.1, 203.0.113.7"}, want: "203.0.113.7,10.0.0.1"},
+		{name: "spoofed trusted address before visitor", remote: "10.0.0.1:5000", xff: []string{"10.0.0.9, 203.0.113.7"}, want: "203.0.113.7,10.0.0.1"},
+		{name: "chain of trusted proxies", remote: "10.0.0.1:5000", xff: []string{"198.51.100.1, 203.0.113.7, 10.0.0.2"}, want: "203.0.113.7,10.0.0.2,10.0.0.1"},
+		{name: "only trusted hops", remote: "10.0.0.1:5000", xff: []string{"10.0.0.3, 10.0.0.2"}, want: "10.0.0.3,10.0.0.2,10.0.0.1"},
+		{name: "several headers", remote: "10.0.0.1:5000", xff: []string{"198.51.100.1", "203.0.113.7, 10.0.0.2"}, want: "203.0.113.7,10.0.0.2,10.0.0.1"},
+		{name: "garbage hop stops the walk", remote: "10.0.0.1:5000", xff: []string{"203.0.113.7, not-an-ip"}, want: "10.0.0.1"},
+		{name: "empty header", remote: "10.0.0.1:5000", xff: []string{""}, want: "10.0.0.1"},
+		{name: "IPv6 trusted proxy", remote: "[2001:db8::1]:5000", xff: []string{"2001:db8::7"}, want: "2001:db8::7,2001:db8::1"},
+		{name: "IPv6 untrusted peer", remote: "[2001:db8::2]:5000", xff: []string{"2001:db8::7"}, want: "2001:db8::2"},
+		{name: "remote address without port", remote: "10.0.0.1", xff: []string{"203.0.113.7"}, want: "203.0.113.7,10.0.0.1"},
+		{name: "unparseable remote address", remote: "pipe", xff: []string{"203.0.113.7"}, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remote
+			for _, v := range tt.xff {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			var got []string
+			for _, ip := range forwardedFor(r) {
+				got = append(got, ip.String())
+			}
+			if strings.Join(got, ",") != tt.want {
+				t.Fatalf("forwardedFor = %v, want %s", got, tt.want)
+			}
+			want := net.ParseIP(strings.Split(tt.want, ",")[0])
+			if ip := clientIP(r); !ip.Equal(want) {
+				t.Fatalf("clientIP = %v, want %v", ip, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,280 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	clusterGossipPath   = "/_cluster/gossip"
+	clusterSecretHeader = "X-Ngopen-Cluster-Secret"
+	clusterHopHeader    = "X-Ngopen-Cluster-Hop"
+)
+
+// ClusterStore records which node holds the session for each hostname and
+// routed custom domain. It is shared by every node in a cluster; gossipStore
+// is the built-in implementation, others (e.g. backed by a database) can be
+// plugged in via the cluster variable.
+type ClusterStore interface {
+	// Claim records that node holds hostname, failing if another node does.
+	Claim(hostname, node string) error
+	// Release forgets the claim, as long as node still holds it.
+	Release(hostname, node string)
+	// Owner returns the node holding hostname.
+	Owner(hostname string) (string, bool)
+}
+
+// cluster is nil when clustering is off. clusterSelf is the internal address
+// peers use to reach this node.
+var (
+	cluster       ClusterStore
+	clusterSelf   = os.Getenv("NGOPEN_CLUSTER_ADDR")
+	clusterSecret = os.Getenv("NGOPEN_CLUSTER_SECRET")
+)
+
+func init() {
+	if clusterSelf == "" {
+		return
+	}
+	if clusterSecret == "" {
+		LogError("NGOPEN_CLUSTER_SECRET must be set to enable cluster mode")
+		return
+	}
+	var peers []string
+	for _, p := range strings.Split(os.Getenv("NGOPEN_CLUSTER_PEERS"), ",") {
+		if p = strings.TrimSpace(p); p != "" && p != clusterSelf {
+			peers = append(peers, p)
+		}
+	}
+	cluster = newGossipStore(clusterSelf, peers, envDuration("NGOPEN_CLUSTER_GOSSIP_INTERVAL", 2*time.Second))
+}
+
+type clusterEntry struct {
+	node    string
+	expires time.Time // zero for our own claims
+}
+
+// gossipStore keeps every node's claims in memory. Each node periodically
+// pushes the full list of hostnames it holds to its peers; entries from a
+// peer expire if it stops gossiping.
+type gossipStore struct {
+	sync.RWMutex
+	self     string
+	peers    []string
+	interval time.Duration
+	entries  map[string]clusterEntry
+	client   *http.Client
+}
+
+type gossipMessage struct {
+	Node      string   `json:"node"`
+	Hostnames []string `json:"hostnames"`
+}
+
+func newGossipStore(self string, peers []string, interval time.Duration) *gossipStore {
+	g := &gossipStore{
+		self:     self,
+		peers:    peers,
+		interval: interval,
+		entries:  make(map[string]clusterEntry),
+		client:   &http.Client{Timeout: interval},
+	}
+	go g.loop()
+	return g
+}
+
+func (g *gossipStore) Claim(hostname, node string) error {
+	g.Lock()
+	if e, ok := g.entries[hostname]; ok && e.node != node && g.live(e) {
+		g.Unlock()
+		return fmt.Errorf("hostname %s is held by node %s", hostname, e.node)
+	}
+	g.entries[hostname] = clusterEntry{node: node}
+	g.Unlock()
+	go g.push()
+	return nil
+}
+
+func (g *gossipStore) Release(hostname, node string) {
+	g.Lock()
+	if e, ok := g.entries[hostname]; ok && e.node == node {
+		delete(g.entries, hostname)
+	}
+	g.Unlock()
+	go g.push()
+}
+
+func (g *gossipStore) Owner(hostname string) (string, bool) {
+	g.RLock()
+	defer g.RUnlock()
+	e, ok := g.entries[hostname]
+	if !ok || !g.live(e) {
+		return "", false
+	}
+	return e.node, true
+}
+
+func (g *gossipStore) live(e clusterEntry) bool {
+	return e.expires.IsZero() || time.Now().Before(e.expires)
+}
+
+func (g *gossipStore) loop() {
+	ticker := time.NewTicker(g.interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		g.push()
+	}
+}
+
+// push sends our current claims to every peer.
+func (g *gossipStore) push() {
+	msg := gossipMessage{Node: g.self}
+	g.RLock()
+	for hostname, e := range g.entries {
+		if e.node == g.self {
+			msg.Hostnames = append(msg.Hostnames, hostname)
+		}
+	}
+	g.RUnlock()
+	body, _ := json.Marshal(msg)
+	for _, peer := range g.peers {
+		req, err := http.NewRequest(http.MethodPost, "http://"+peer+clusterGossipPath, bytes.NewReader(body))
+		if err != nil {
+			continue
+		}
+		req.Header.Set(clusterSecretHeader, clusterSecret)
+		resp, err := g.client.Do(req)
+		if err != nil {
+			LogDebug("Gossip to %s failed: %v", peer, err)
+			continue
+		}
+		resp.Body.Close()
+	}
+}
+
+// receive replaces everything we know about msg.Node with its latest claims.
+func (g *gossipStore) receive(msg gossipMessage) {
+	expires := time.Now().Add(3 * g.interval)
+	g.Lock()
+	defer g.Unlock()
+	for hostname, e := range g.entries {
+		if e.node == msg.Node {
+			delete(g.entries, hostname)
+		}
+	}
+	for _, hostname := range msg.Hostnames {
+		if e, ok := g.entries[hostname]; ok && e.node == g.self {
+			LogWarn("Node %s also claims '%s', keeping our session", msg.Node, hostname)
+			continue
+		}
+		g.entries[hostname] = clusterEntry{node: msg.Node, expires: expires}
+	}
+}
+
+type clusterPeerKey struct{}
+
+// fromClusterPeer reports whether r was forwarded by an authenticated peer.
+func fromClusterPeer(r *http.Request) bool {
+	v, _ := r.Context().Value(clusterPeerKey{}).(bool)
+	return v
+}
+
+func validClusterSecret(r *http.Request) bool {
+	got := r.Header.Get(clusterSecretHeader)
+	return subtle.ConstantTimeCompare([]byte(got), []byte(clusterSecret)) == 1
+}
+
+// forwardToOwner proxies r to the node holding hostname, which may be a
+// tunnel hostname or a custom domain. It reports false if no other node holds
+// it or r has already been forwarded once.
+func forwardToOwner(w http.ResponseWriter, r *http.Request, hostname string) bool {
+	if cluster == nil || fromClusterPeer(r) {
+		return false
+	}
+	owner, ok := cluster.Owner(normalizeDomain(hostname))
+	if !ok || owner == clusterSelf {
+		return false
+	}
+	target := &url.URL{Scheme: "http", Host: owner}
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	director := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		director(req)
+		req.Host = r.Host
+		req.Header.Set("X-Forwarded-Proto", requestScheme(r))
+		req.Header.Set(clusterSecretHeader, clusterSecret)
+		req.Header.Set(clusterHopHeader, clusterSelf)
+	}
+	proxy.ErrorHandler = func(w http.ResponseWriter, req *http.Request, err error) {
+		LogError("Forwarding '%s' to node %s failed: %v", hostname, owner, err)
+		renderError(w, req, http.StatusBadGateway, errorNodeUnreachable, "")
+	}
+	LogDebug("Forwarding request for '%s' to node %s", hostname, owner)
+	proxy.ServeHTTP(w, r)
+	return true
+}
+
+// StartClusterListener serves gossip and requests forwarded by peers on the
+// internal cluster address. It does nothing when clustering is off.
+func StartClusterListener(registry *TunnelRegistry) {
+	if cluster == nil {
+		return
+	}
+	if os.Getenv("NGOPEN_DOMAIN_SECRET") == "" {
+		// Each node would hand out its own challenge tokens, so whether a
+		// domain verifies would depend on which node answered.
+		LogWarn("Cluster mode without NGOPEN_DOMAIN_SECRET: custom domain challenge tokens differ between nodes; set the same secret on every node")
+	}
+	listen := os.Getenv("NGOPEN_CLUSTER_LISTEN")
+	if listen == "" {
+		listen = clusterSelf
+	}
+	proxy := proxyHandler(registry)
+	mux := http.NewServeMux()
+	mux.HandleFunc(clusterGossipPath, func(w http.ResponseWriter, r *http.Request) {
+		if !validClusterSecret(r) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		var msg gossipMessage
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+			http.Error(w, "Bad gossip", http.StatusBadRequest)
+			return
+		}
+		if g, ok := cluster.(*gossipStore); ok {
+			g.receive(msg)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if !validClusterSecret(r) || r.Header.Get(clusterHopHeader) == "" {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		r.Header.Del(clusterSecretHeader)
+		r.Header.Del(clusterHopHeader)
+		proxy(w, r.WithContext(context.WithValue(r.Context(), clusterPeerKey{}, true)))
+	})
+	serve := &http.Server{
+		Addr:           listen,
+		Handler:        mux,
+		ReadTimeout:    30 * time.Second,
+		WriteTimeout:   30 * time.Second,
+		MaxHeaderBytes: 1 << 20,
+	}
+	trackServer(serve)
+	LogInfo("Cluster node %s listening on %s", clusterSelf, listen)
+	if err := serveUntilDrained(serve.ListenAndServe); err != nil {
+		LogError("Cluster listener error: %v", err)
+	}
+}
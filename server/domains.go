@@ -0,0 +1,250 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/heysubinoy/ngopen/protocol"
+)
+
+const (
+	domainTXTPrefix = "_ngopen-challenge."
+	domainTXTValue  = "ngopen-verify="
+)
+
+// Unverified domains are rechecked this often while their tunnel is
+// connected, for up to domainVerifyTimeout.
+var (
+	domainVerifyInterval = 30 * time.Second
+	domainVerifyTimeout  = 15 * time.Minute
+)
+
+// Resolver is the part of net.Resolver used to check TXT records, so a fake
+// resolver can stand in for real DNS.
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// CustomDomain is a user-owned domain attached to a tunnel.
+type CustomDomain struct {
+	Domain   string    `json:"domain"`
+	UserID   string    `json:"userId"`
+	Tunnel   string    `json:"-"` // hostname of the tunnel currently serving the domain
+	Verified time.Time `json:"verified"`
+}
+
+// DomainStore tracks verified custom domains and which tunnel serves them.
+type DomainStore struct {
+	sync.RWMutex
+	domains  map[string]*CustomDomain
+	secret   []byte
+	Resolver Resolver
+}
+
+var domains = NewDomainStore()
+
+func NewDomainStore() *DomainStore {
+	secret := []byte(os.Getenv("NGOPEN_DOMAIN_SECRET"))
+	if len(secret) == 0 {
+		secret = make([]byte, 32)
+		rand.Read(secret)
+	}
+	d := &DomainStore{
+		domains:  make(map[string]*CustomDomain),
+		secret:   secret,
+		Resolver: net.DefaultResolver,
+	}
+	for _, cd := range store.Domains() {
+		d.domains[cd.Domain] = &cd
+	}
+	return d
+}
+
+// normalizeDomain lowercases a host and strips any port and trailing dot.
+func normalizeDomain(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// ChallengeToken returns the value a user must publish to prove they own domain.
+func (d *DomainStore) ChallengeToken(userID, domain string) string {
+	mac := hmac.New(sha256.New, d.secret)
+	mac.Write([]byte(userID + "|" + normalizeDomain(domain)))
+	return hex.EncodeToString(mac.Sum(nil))[:32]
+}
+
+// Check reports whether userID may claim domain without touching the
+// network: it fails for disallowed domains and ones verified by another user,
+// and reports whether userID has already verified it.
+func (d *DomainStore) Check(userID, domain string) (verified bool, err error) {
+	domain = normalizeDomain(domain)
+	if domain == "" || strings.HasSuffix(domain, hostnameSuffix) {
+		return false, fmt.Errorf("domain %q is not allowed", domain)
+	}
+	d.RLock()
+	existing, ok := d.domains[domain]
+	d.RUnlock()
+	if !ok {
+		return false, nil
+	}
+	if existing.UserID != userID {
+		return false, fmt.Errorf("domain %s is owned by another user", domain)
+	}
+	return true, nil
+}
+
+// Verify checks that userID controls domain through a TXT record at
+// _ngopen-challenge.<domain> holding their challenge token. Pointing the
+// domain at this server is not enough, since that proves nothing about who
+// owns it. Domains verified once stay bound to their owner.
+func (d *DomainStore) Verify(userID, domain string) error {
+	domain = normalizeDomain(domain)
+	if verified, err := d.Check(userID, domain); err != nil || verified {
+		return err
+	}
+
+	token := d.ChallengeToken(userID, domain)
+	if !d.checkTXT(domain, token) {
+		return fmt.Errorf("domain %s is not verified: add a TXT record %s%s with value %s%s",
+			domain, domainTXTPrefix, domain, domainTXTValue, token)
+	}
+	cd := &CustomDomain{Domain: domain, UserID: userID, Verified: time.Now()}
+	d.Lock()
+	if existing, ok := d.domains[domain]; ok && existing.UserID != userID {
+		d.Unlock()
+		return fmt.Errorf("domain %s is owned by another user", domain)
+	}
+	d.domains[domain] = cd
+	d.Unlock()
+	if err := store.SaveDomain(*cd); err != nil {
+		LogError("Failed to persist custom domain '%s': %v", domain, err)
+	}
+	LogInfo("Custom domain '%s' verified for user '%s'", domain, userID)
+	return nil
+}
+
+func (d *DomainStore) checkTXT(domain, token string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	records, err := d.Resolver.LookupTXT(ctx, domainTXTPrefix+domain)
+	if err != nil {
+		LogDebug("TXT lookup for %s failed: %v", domain, err)
+		return false
+	}
+	for _, rec := range records {
+		if strings.TrimSpace(rec) == domainTXTValue+token {
+			return true
+		}
+	}
+	return false
+}
+
+// awaitVerification keeps checking client's domain in the background until
+// it verifies, the tunnel goes away or domainVerifyTimeout passes, keeping
+// DNS lookups out of the handshake. The client is told how it went.
+func (d *DomainStore) awaitVerification(client *Client, done <-chan struct{}) {
+	deadline := time.Now().Add(domainVerifyTimeout)
+	for attempt := 0; ; attempt++ {
+		err := d.Verify(client.UserID, client.Domain)
+		if err == nil {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			d.route(client)
+			client.Notify(protocol.ControlMessage{Type: protocol.ControlNotice, Reason: "Custom domain " + client.Domain + " is verified and now routed to this tunnel"})
+			return
+		}
+		if attempt == 0 {
+			client.Notify(protocol.ControlMessage{Type: protocol.ControlNotice, Reason: err.Error() + " (checking again every " + domainVerifyInterval.String() + ")"})
+		}
+		if time.Now().After(deadline) {
+			LogWarn("Gave up verifying custom domain '%s': %v", client.Domain, err)
+			client.Notify(protocol.ControlMessage{Type: protocol.ControlNotice, Reason: "Gave up verifying " + client.Domain + "; reconnect once the TXT record is in place"})
+			return
+		}
+		select {
+		case <-done:
+			return
+		case <-time.After(domainVerifyInterval):
+		}
+	}
+}
+
+// Attach routes domain to the tunnel registered under tunnel. It reports
+// false if the domain has not been verified yet.
+func (d *DomainStore) Attach(domain, tunnel string) bool {
+	d.Lock()
+	defer d.Unlock()
+	cd, ok := d.domains[normalizeDomain(domain)]
+	if ok {
+		cd.Tunnel = tunnel
+	}
+	return ok
+}
+
+// route attaches client's domain to it if the domain is verified. In cluster
+// mode the domain is claimed like a hostname, so peers forward its visitors
+// to this node.
+func (d *DomainStore) route(client *Client) bool {
+	if !d.Attach(client.Domain, client.Name) {
+		return false
+	}
+	if cluster != nil {
+		if err := cluster.Claim(normalizeDomain(client.Domain), clusterSelf); err != nil {
+			LogWarn("Cluster claim for custom domain failed: %v", err)
+		}
+	}
+	LogInfo("Custom domain '%s' routed to '%s'", client.Domain, client.Name)
+	return true
+}
+
+// unroute undoes route once client's tunnel is gone.
+func (d *DomainStore) unroute(client *Client) {
+	d.Detach(client.Domain, client.Name)
+	if cluster != nil {
+		cluster.Release(normalizeDomain(client.Domain), clusterSelf)
+	}
+}
+
+// Detach stops routing domain, as long as it still points at tunnel.
+func (d *DomainStore) Detach(domain, tunnel string) {
+	d.Lock()
+	defer d.Unlock()
+	if cd, ok := d.domains[normalizeDomain(domain)]; ok && cd.Tunnel == tunnel {
+		cd.Tunnel = ""
+	}
+}
+
+// Lookup returns the tunnel hostname currently serving host.
+func (d *DomainStore) Lookup(host string) (string, bool) {
+	d.RLock()
+	defer d.RUnlock()
+	cd, ok := d.domains[normalizeDomain(host)]
+	if !ok || cd.Tunnel == "" {
+		return "", false
+	}
+	return cd.Tunnel, true
+}
+
+// HostPolicy only lets certificates be issued for verified domains.
+func (d *DomainStore) HostPolicy(_ context.Context, host string) error {
+	d.RLock()
+	defer d.RUnlock()
+	if _, ok := d.domains[normalizeDomain(host)]; !ok {
+		return fmt.Errorf("host %q is not a verified custom domain", host)
+	}
+	return nil
+}
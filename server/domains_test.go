@@ -0,0 +1,178 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeResolver answers TXT lookups from a map instead of DNS.
+type fakeResolver map[string][]string
+
+func (f fakeResolver) LookupTXT(_ context.Context, name string) ([]string, error) {
+	records, ok := f[name]
+	if !ok {
+		return nil, errors.New("no such host")
+	}
+	return records, nil
+}
+
+// newTestDomainStore returns a DomainStore backed by a fresh in-memory store.
+func newTestDomainStore(t *testing.T) *DomainStore {
+	saved := store
+	store, _ = NewFileStore("")
+	t.Cleanup(func() { store = saved })
+	return NewDomainStore()
+}
+
+func TestVerifyWithTXTRecord(t *testing.T) {
+	d := newTestDomainStore(t)
+	d.Resolver = fakeResolver{
+		"_ngopen-challenge.dev.example.com": {"unrelated", domainTXTValue + d.ChallengeToken("u1", "dev.example.com")},
+	}
+
+	if err := d.Verify("u1", "Dev.Example.com."); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if verified, err := d.Check("u1", "dev.example.com"); !verified || err != nil {
+		t.Fatalf("Check after Verify = %v, %v; want verified", verified, err)
+	}
+	if !d.Attach("dev.example.com", "a.n.sbn.lol") {
+		t.Fatal("Attach of a verified domain failed")
+	}
+	if tunnel, ok := d.Lookup("dev.example.com:443"); !ok || tunnel != "a.n.sbn.lol" {
+		t.Fatalf("Lookup = %q, %v", tunnel, ok)
+	}
+}
+
+func TestVerifyFailures(t *testing.T) {
+	tests := []struct {
+		name    string
+		records func(d *DomainStore) fakeResolver
+		domain  string
+		want    string
+	}{
+		{
+			name:    "no record",
+			records: func(*DomainStore) fakeResolver { return fakeResolver{} },
+			domain:  "dev.example.com",
+			want:    "add a TXT record",
+		},
+		{
+			name: "another user's token",
+			records: func(d *DomainStore) fakeResolver {
+				return fakeResolver{"_ngopen-challenge.dev.example.com": {domainTXTValue + d.ChallengeToken("u2", "dev.example.com")}}
+			},
+			domain: "dev.example.com",
+			want:   "add a TXT record",
+		},
+		{
+			name:    "tunnel hostname",
+			records: func(*DomainStore) fakeResolver { return fakeResolver{} },
+			domain:  "foo" + hostnameSuffix,
+			want:    "not allowed",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newTestDomainStore(t)
+			d.Resolver = tt.records(d)
+			err := d.Verify("u1", tt.domain)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("Verify error = %v, want it to mention %q", err, tt.want)
+			}
+			if d.Attach(tt.domain, "a.n.sbn.lol") {
+				t.Fatal("Attach succeeded for an unverified domain")
+			}
+			if _, ok := d.Lookup(tt.domain); ok {
+				t.Fatal("unverified domain is routed")
+			}
+		})
+	}
+}
+
+func TestVerifiedDomainStaysWithOwner(t *testing.T) {
+	d := newTestDomainStore(t)
+	d.Resolver = fakeResolver{"_ngopen-challenge.dev.example.com": {
+		domainTXTValue + d.ChallengeToken("u1", "dev.example.com"),
+		domainTXTValue + d.ChallengeToken("u2", "dev.example.com"),
+	}}
+	if err := d.Verify("u1", "dev.example.com"); err != nil {
+		t.Fatalf("Verify u1: %v", err)
+	}
+	if err := d.Verify("u2", "dev.example.com"); err == nil || !strings.Contains(err.Error(), "owned by another user") {
+		t.Fatalf("Verify u2 error = %v, want owned by another user", err)
+	}
+	if _, err := d.Check("u2", "dev.example.com"); err == nil {
+		t.Fatal("Check let another user claim a verified domain")
+	}
+}
+
+func TestAwaitVerificationPicksUpLateRecord(t *testing.T) {
+	d := newTestDomainStore(t)
+	resolver := &lateResolver{}
+	d.Resolver = resolver
+	savedInterval := domainVerifyInterval
+	domainVerifyInterval = time.Millisecond
+	t.Cleanup(func() { domainVerifyInterval = savedInterval })
+
+	resolver.set(fakeResolver{})
+	client := &Client{Name: "a.n.sbn.lol", UserID: "u1", Domain: "dev.example.com"}
+	finished := make(chan struct{})
+	go func() {
+		d.awaitVerification(client, make(chan struct{}))
+		close(finished)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if _, ok := d.Lookup("dev.example.com"); ok {
+		t.Fatal("domain routed before its TXT record exists")
+	}
+
+	resolver.set(fakeResolver{"_ngopen-challenge.dev.example.com": {domainTXTValue + d.ChallengeToken("u1", "dev.example.com")}})
+	select {
+	case <-finished:
+	case <-time.After(time.Second):
+		t.Fatal("awaitVerification did not finish after the record appeared")
+	}
+	if tunnel, ok := d.Lookup("dev.example.com"); !ok || tunnel != client.Name {
+		t.Fatalf("Lookup = %q, %v; want %s", tunnel, ok, client.Name)
+	}
+}
+
+func TestAwaitVerificationStopsWithTunnel(t *testing.T) {
+	d := newTestDomainStore(t)
+	d.Resolver = fakeResolver{}
+	done := make(chan struct{})
+	close(done)
+	finished := make(chan struct{})
+	go func() {
+		d.awaitVerification(&Client{Name: "a.n.sbn.lol", UserID: "u1", Domain: "dev.example.com"}, done)
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(time.Second):
+		t.Fatal("awaitVerification kept running after the tunnel closed")
+	}
+}
+
+// lateResolver lets a test publish records while a lookup loop runs.
+type lateResolver struct {
+	mu      sync.Mutex
+	records fakeResolver
+}
+
+func (l *lateResolver) set(records fakeResolver) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.records = records
+}
+
+func (l *lateResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.records.LookupTXT(ctx, name)
+}
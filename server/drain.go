@@ -0,0 +1,115 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/heysubinoy/ngopen/protocol"
+)
+
+var (
+	drainTimeout        = envDuration("NGOPEN_DRAIN_TIMEOUT", 30*time.Second)
+	drainReconnectDelay = envDuration("NGOPEN_DRAIN_RECONNECT_DELAY", 5*time.Second)
+	drainRedirect       = os.Getenv("NGOPEN_DRAIN_REDIRECT") // tunnel server clients should move to
+)
+
+var (
+	draining  atomic.Bool
+	drainDone = make(chan struct{})
+
+	httpServersMu sync.Mutex
+	httpServers   []*http.Server
+)
+
+// Draining reports whether the server has stopped accepting new tunnels.
+func Draining() bool {
+	return draining.Load()
+}
+
+// trackServer registers an HTTP server to be shut down gracefully on drain.
+func trackServer(s *http.Server) {
+	httpServersMu.Lock()
+	defer httpServersMu.Unlock()
+	httpServers = append(httpServers, s)
+}
+
+// serveUntilDrained runs serve and, if it stopped because of a drain, waits
+// for the drain to finish instead of returning straight away.
+func serveUntilDrained(serve func() error) error {
+	err := serve()
+	if err == http.ErrServerClosed {
+		<-drainDone
+		return nil
+	}
+	return err
+}
+
+// HandleDrainSignals drains the server on SIGTERM or SIGINT, then exits.
+func HandleDrainSignals(registry *TunnelRegistry) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-signals
+	LogInfo("Received %v, draining", sig)
+	audit.Record(AuditEntry{Action: AuditDrain, Actor: "system", Success: true, Reason: "received " + sig.String()})
+	Drain(registry, drainTimeout)
+	os.Exit(0)
+}
+
+// Drain stops accepting tunnels, tells connected clients where and when to
+// reconnect, lets in-flight requests finish until timeout and then closes
+// every tunnel.
+func Drain(registry *TunnelRegistry, timeout time.Duration) {
+	if !draining.CompareAndSwap(false, true) {
+		return
+	}
+	reason := "server is restarting"
+	if drainRedirect != "" {
+		reason = "server is shutting down, please move to " + drainRedirect
+	}
+	clients := registry.List()
+	LogInfo("Draining %d tunnel(s), waiting up to %v for in-flight requests", len(clients), timeout)
+	var notified sync.WaitGroup
+	for _, c := range clients {
+		notified.Add(1)
+		go func(c *Client) {
+			defer notified.Done()
+			c.Notify(protocol.ControlMessage{
+				Type:   protocol.ControlReconnect,
+				Reason: reason,
+				Delay:  drainReconnectDelay,
+				Server: drainRedirect,
+			})
+		}(c)
+	}
+	notified.Wait()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	httpServersMu.Lock()
+	servers := append([]*http.Server(nil), httpServers...)
+	httpServersMu.Unlock()
+	var wg sync.WaitGroup
+	for _, s := range servers {
+		wg.Add(1)
+		go func(s *http.Server) {
+			defer wg.Done()
+			if err := s.Shutdown(ctx); err != nil {
+				LogWarn("HTTP server did not drain in time: %v", err)
+			}
+		}(s)
+	}
+	wg.Wait()
+
+	for _, c := range clients {
+		registry.Remove(c)
+	}
+	quotas.Flush()
+	LogInfo("Drain complete")
+	close(drainDone)
+}
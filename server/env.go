@@ -0,0 +1,46 @@
+package server
+
+import (
+	"os"
+	"strconv"
+	"time"
+)
+
+func envInt(name string, def int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		LogError("Invalid %s=%q, using %d", name, v, def)
+		return def
+	}
+	return n
+}
+
+func envFloat(name string, def float64) float64 {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		LogError("Invalid %s=%q, using %v", name, v, def)
+		return def
+	}
+	return f
+}
+
+func envDuration(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		LogError("Invalid %s=%q, using %v", name, v, def)
+		return def
+	}
+	return d
+}
@@ -0,0 +1,219 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"embed"
+	"encoding/hex"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/heysubinoy/ngopen/protocol"
+)
+
+// Error codes shown on error pages and in JSON errors.
+const (
+	errorTunnelOffline    = "tunnel_offline"
+	errorTunnelFailed     = "tunnel_error"
+	errorTimeout          = "timeout"
+	errorLocalServiceDown = protocol.UpstreamUnreachable
+	errorLocalTimeout     = protocol.UpstreamTimeout
+	errorLocalFailed      = protocol.UpstreamFailed
+	errorServiceStarting  = "service_starting"
+	errorRateLimited      = "rate_limited"
+	errorQuotaExceeded    = "quota_exceeded"
+	errorForbidden        = "forbidden"
+	errorUnauthorized     = "unauthorized"
+	errorBadRequest       = "bad_request"
+	errorNodeUnreachable  = "node_unreachable"
+	errorLoginUnavailable = "login_unavailable"
+	errorInternal         = "internal_error"
+)
+
+const requestIDHeader = "X-Request-Id"
+
+// errorContent is the default wording for an error code.
+type errorContent struct {
+	Title   string
+	Message string
+	Hint    string
+}
+
+var errorContents = map[string]errorContent{
+	errorTunnelOffline: {
+		Title:   "🚧 Tunnel Offline",
+		Message: "There is no ngopen tunnel connected for this address right now.",
+		Hint:    "If this is your tunnel, check that ngopen is running and still connected.",
+	},
+	errorTunnelFailed: {
+		Title:   "🚧 Tunnel Error",
+		Message: "The request could not be passed through the tunnel.",
+		Hint:    "The tunnel may be reconnecting. Try again in a moment.",
+	},
+	errorTimeout: {
+		Title:   "⏱ Gateway Timeout",
+		Message: "The service behind this tunnel took too long to respond.",
+	},
+	errorLocalServiceDown: {
+		Title:   "🔌 Local Service Down",
+		Message: "The tunnel is connected, but the service it forwards to is not answering.",
+		Hint:    "If this is your tunnel, check that your local server is started and listening on the forwarded port.",
+	},
+	errorLocalTimeout: {
+		Title:   "⏱ Local Service Timeout",
+		Message: "The tunnel is connected, but the service it forwards to did not answer in time.",
+	},
+	errorLocalFailed: {
+		Title:   "🔌 Local Service Error",
+		Message: "The tunnel is connected, but forwarding the request to the local service failed.",
+	},
+	errorServiceStarting: {
+		Title:   "⏳ Service Starting Up",
+		Message: "The tunnel is connected, but the service behind it is not ready yet.",
+		Hint:    "Try again in a few seconds.",
+	},
+	errorRateLimited: {
+		Title:   "🐢 Too Many Requests",
+		Message: "This tunnel is receiving more requests than it is allowed to handle.",
+		Hint:    "Please wait a moment and try again.",
+	},
+	errorQuotaExceeded: {
+		Title:   "📦 Quota Exceeded",
+		Message: "This tunnel has used up its transfer quota.",
+		Hint:    "Please try again later.",
+	},
+	errorForbidden: {
+		Title:   "⛔ Forbidden",
+		Message: "You are not allowed to access this tunnel.",
+	},
+	errorUnauthorized: {
+		Title:   "🔒 Unauthorized",
+		Message: "This tunnel requires you to log in.",
+	},
+	errorBadRequest: {
+		Title:   "Bad Request",
+		Message: "The request could not be understood.",
+	},
+	errorNodeUnreachable: {
+		Title:   "🚧 Tunnel Node Unreachable",
+		Message: "The server holding this tunnel could not be reached.",
+		Hint:    "Try again in a moment.",
+	},
+	errorLoginUnavailable: {
+		Title:   "🔒 Login Unavailable",
+		Message: "Logging in to this tunnel is not possible right now.",
+	},
+	errorInternal: {
+		Title:   "Internal Error",
+		Message: "Something went wrong on the ngopen server.",
+	},
+}
+
+//go:embed templates/*.html
+var embeddedTemplates embed.FS
+
+// errorTemplates holds the embedded defaults, overridden by any .html files
+// in NGOPEN_TEMPLATE_DIR. Pages are looked up as <code>.html, then
+// <status>.html, then error.html.
+var errorTemplates = loadErrorTemplates(os.Getenv("NGOPEN_TEMPLATE_DIR"))
+
+func loadErrorTemplates(dir string) *template.Template {
+	t := template.Must(template.New("").ParseFS(embeddedTemplates, "templates/*.html"))
+	if dir == "" {
+		return t
+	}
+	matches, _ := filepath.Glob(filepath.Join(dir, "*.html"))
+	if len(matches) == 0 {
+		LogWarn("No templates found in %s, using the built-in pages", dir)
+		return t
+	}
+	overridden, err := t.ParseFiles(matches...)
+	if err != nil {
+		LogError("Failed to load templates from %s, using the built-in pages: %v", dir, err)
+		return template.Must(template.New("").ParseFS(embeddedTemplates, "templates/*.html"))
+	}
+	LogInfo("Loaded %d error template(s) from %s", len(matches), dir)
+	return overridden
+}
+
+// ErrorPage is the data passed to error templates and returned as JSON.
+type ErrorPage struct {
+	Status     int    `json:"status"`
+	StatusText string `json:"-"`
+	Code       string `json:"error"`
+	Title      string `json:"-"`
+	Message    string `json:"message"`
+	Hint       string `json:"-"`
+	Detail     string `json:"detail,omitempty"`
+	Hostname   string `json:"hostname,omitempty"`
+	RequestID  string `json:"requestId,omitempty"`
+}
+
+// newRequestID returns a short random ID used to correlate error pages with
+// server logs.
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// wantsJSON reports whether the visitor prefers a JSON error over HTML.
+func wantsJSON(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "application/json") && !strings.Contains(accept, "text/html")
+}
+
+// renderError writes an error page for code, or a JSON error if the visitor
+// asked for one. detail is optional extra information shown to the visitor.
+func renderError(w http.ResponseWriter, r *http.Request, status int, code, detail string) {
+	content, ok := errorContents[code]
+	if !ok {
+		content = errorContent{Title: http.StatusText(status), Message: http.StatusText(status)}
+	}
+	page := ErrorPage{
+		Status:     status,
+		StatusText: http.StatusText(status),
+		Code:       code,
+		Title:      content.Title,
+		Message:    content.Message,
+		Hint:       content.Hint,
+		Detail:     detail,
+		Hostname:   normalizeDomain(r.Host),
+		RequestID:  w.Header().Get(requestIDHeader),
+	}
+
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Cache-Control", "no-store")
+	h.Set("X-Content-Type-Options", "nosniff")
+	if wantsJSON(r) {
+		h.Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(page)
+		return
+	}
+
+	var buf bytes.Buffer
+	for _, name := range []string{code + ".html", strconv.Itoa(status) + ".html", "error.html"} {
+		if t := errorTemplates.Lookup(name); t != nil {
+			if err := t.Execute(&buf, page); err != nil {
+				LogError("Failed to render error template %s: %v", name, err)
+				buf.Reset()
+				continue
+			}
+			break
+		}
+	}
+	if buf.Len() == 0 {
+		http.Error(w, page.Message, status)
+		return
+	}
+	h.Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,180 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tunnel lifecycle event types.
+const (
+	EventTunnelAuthenticated = "tunnel.authenticated"
+	EventTunnelConnected     = "tunnel.connected"
+	EventTunnelDisconnected  = "tunnel.disconnected"
+	EventAuthFailed          = "auth.failed"
+	EventQuotaExceeded       = "quota.exceeded"
+)
+
+const (
+	webhookSignatureHeader = "X-Ngopen-Signature"
+	webhookEventHeader     = "X-Ngopen-Event"
+	webhookQueueSize       = 1024
+	webhookAttempts        = 3
+)
+
+// Event describes something that happened to a tunnel.
+type Event struct {
+	Type       string    `json:"type"`
+	Time       time.Time `json:"time"`
+	Hostname   string    `json:"hostname,omitempty"`
+	UserID     string    `json:"userId,omitempty"`
+	Domain     string    `json:"domain,omitempty"`
+	RemoteAddr string    `json:"remoteAddr,omitempty"`
+	Reason     string    `json:"reason,omitempty"`
+}
+
+// clientEvent builds an event of type kind describing c.
+func clientEvent(kind string, c *Client) Event {
+	return Event{
+		Type:       kind,
+		Hostname:   c.Name,
+		UserID:     c.UserID,
+		Domain:     c.Domain,
+		RemoteAddr: c.RemoteAddr,
+	}
+}
+
+// EventBus fans events out to webhooks and live subscribers (the admin SSE
+// stream). Delivery never blocks the caller: webhooks are sent from a
+// background queue and slow subscribers miss events.
+type EventBus struct {
+	sync.Mutex
+	webhooks    []string
+	secret      []byte
+	client      *http.Client
+	queue       chan Event
+	subscribers map[chan Event]struct{}
+}
+
+var events = NewEventBus(splitEnvList("NGOPEN_WEBHOOK_URLS"), os.Getenv("NGOPEN_WEBHOOK_SECRET"))
+
+func NewEventBus(webhooks []string, secret string) *EventBus {
+	b := &EventBus{
+		webhooks:    webhooks,
+		secret:      []byte(secret),
+		client:      &http.Client{Timeout: 10 * time.Second},
+		subscribers: make(map[chan Event]struct{}),
+	}
+	if len(webhooks) > 0 {
+		if secret == "" {
+			LogWarn("NGOPEN_WEBHOOK_SECRET is not set, webhooks will be sent unsigned")
+		}
+		b.queue = make(chan Event, webhookQueueSize)
+		go b.deliverLoop()
+	}
+	return b
+}
+
+// splitEnvList reads a comma separated list from the environment.
+func splitEnvList(name string) []string {
+	var out []string
+	for _, v := range strings.Split(os.Getenv(name), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// Emit publishes e, stamping its time if unset.
+func (b *EventBus) Emit(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	LogDebug("Event %s for '%s'", e.Type, e.Hostname)
+	b.Lock()
+	for ch := range b.subscribers {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+	b.Unlock()
+	if b.queue != nil {
+		select {
+		case b.queue <- e:
+		default:
+			LogWarn("Webhook queue full, dropping %s event", e.Type)
+		}
+	}
+}
+
+// Subscribe returns a channel receiving every event emitted from now on.
+// Call Unsubscribe when done.
+func (b *EventBus) Subscribe() chan Event {
+	ch := make(chan Event, 64)
+	b.Lock()
+	b.subscribers[ch] = struct{}{}
+	b.Unlock()
+	return ch
+}
+
+func (b *EventBus) Unsubscribe(ch chan Event) {
+	b.Lock()
+	delete(b.subscribers, ch)
+	b.Unlock()
+}
+
+func (b *EventBus) deliverLoop() {
+	for e := range b.queue {
+		body, err := json.Marshal(e)
+		if err != nil {
+			continue
+		}
+		for _, url := range b.webhooks {
+			b.deliver(url, e.Type, body)
+		}
+	}
+}
+
+// deliver posts body to url, retrying with a short backoff on failure.
+func (b *EventBus) deliver(url, kind string, body []byte) {
+	for attempt := 1; attempt <= webhookAttempts; attempt++ {
+		req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+		if err != nil {
+			LogError("Invalid webhook URL %s: %v", url, err)
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(webhookEventHeader, kind)
+		if len(b.secret) > 0 {
+			req.Header.Set(webhookSignatureHeader, "sha256="+b.sign(body))
+		}
+		resp, err := b.client.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode < 300 {
+				return
+			}
+			LogWarn("Webhook %s answered %s (attempt %d)", url, resp.Status, attempt)
+		} else {
+			LogWarn("Webhook %s failed (attempt %d): %v", url, attempt, err)
+		}
+		time.Sleep(time.Duration(attempt) * time.Second)
+	}
+}
+
+// sign returns the hex HMAC-SHA256 of body, which receivers recompute with
+// the shared secret to check the X-Ngopen-Signature header.
+func (b *EventBus) sign(body []byte) string {
+	mac := hmac.New(sha256.New, b.secret)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
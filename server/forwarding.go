@@ -0,0 +1,58 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// setForwardedHeaders replaces the forwarding headers on r with ones we vouch
+// for: X-Forwarded-For/-Proto/-Host and the RFC 7239 Forwarded header.
+// Whatever the visitor sent is dropped; only the part of the chain added by
+// trusted proxies is kept.
+func setForwardedHeaders(r *http.Request) {
+	proto := requestScheme(r)
+	host := r.Host
+	if h := r.Header.Get("X-Forwarded-Host"); h != "" && trustedPeer(r) {
+		host = h
+	}
+	chain := forwardedFor(r)
+	for _, name := range []string{"X-Forwarded-For", "X-Forwarded-Proto", "X-Forwarded-Host", "Forwarded"} {
+		r.Header.Del(name)
+	}
+	r.Header.Set("X-Forwarded-Proto", proto)
+	r.Header.Set("X-Forwarded-Host", host)
+
+	// The first element describes the visitor's original request, which is
+	// where most frameworks look for host and proto.
+	hops := make([]string, len(chain))
+	elements := make([]string, len(chain))
+	for i, ip := range chain {
+		hops[i] = ip.String()
+		elements[i] = "for=" + forwardedNode(ip)
+	}
+	if len(chain) == 0 {
+		elements = []string{""}
+	} else {
+		r.Header.Set("X-Forwarded-For", strings.Join(hops, ", "))
+		elements[0] += ";"
+	}
+	elements[0] += "host=" + forwardedValue(host) + ";proto=" + proto
+	r.Header.Set("Forwarded", strings.Join(elements, ", "))
+}
+
+// forwardedNode formats ip as a Forwarded node, bracketing and quoting IPv6.
+func forwardedNode(ip net.IP) string {
+	if ip.To4() == nil {
+		return `"[` + ip.String() + `]"`
+	}
+	return ip.String()
+}
+
+// forwardedValue quotes v unless it is a plain token.
+func forwardedValue(v string) string {
+	if strings.ContainsAny(v, ":[]\" ,;=") {
+		return `"` + strings.ReplaceAll(v, `"`, `\"`) + `"`
+	}
+	return v
+}
@@ -7,8 +7,13 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"time"
 )
 
+// streamIdleTimeout is how long a response body may stall before the
+// stream is given up on.
+const streamIdleTimeout = 1 * time.Minute
+
 // writeFramedRequest writes an HTTP request into the given stream.
 func WriteFramedRequest(stream net.Conn, req *http.Request) error {
 	var buf bytes.Buffer
@@ -19,20 +24,34 @@ func WriteFramedRequest(stream net.Conn, req *http.Request) error {
 	length := uint32(len(data))
 	header := make([]byte, 4)
 	binary.BigEndian.PutUint32(header, length)
+	// The deadline starts once the body has been read, however long a
+	// shaped upload took.
+	stream.SetWriteDeadline(time.Now().Add(streamIdleTimeout))
 	_, err := stream.Write(append(header, data...))
 	return err
 }
 
 // readFramedResponse reads a framed HTTP response from the given stream.
+// Only the head is read here; the body is read from the stream as the
+// caller consumes it, so large responses are never held in memory.
 func ReadFramedResponse(stream net.Conn, req *http.Request) (*http.Response, error) {
+	r := idleReader{stream}
 	header := make([]byte, 4)
-	if _, err := io.ReadFull(stream, header); err != nil {
+	if _, err := io.ReadFull(r, header); err != nil {
 		return nil, err
 	}
 	length := binary.BigEndian.Uint32(header)
-	body := make([]byte, length)
-	if _, err := io.ReadFull(stream, body); err != nil {
-		return nil, err
-	}
-	return http.ReadResponse(bufio.NewReader(bytes.NewReader(body)), req)
+	frame := io.LimitReader(r, int64(length))
+	return http.ReadResponse(bufio.NewReader(frame), req)
+}
+
+// idleReader pushes the read deadline forward on every read, so a body
+// that keeps arriving is never cut off but a stalled one is.
+type idleReader struct {
+	conn net.Conn
+}
+
+func (r idleReader) Read(p []byte) (int, error) {
+	r.conn.SetReadDeadline(time.Now().Add(streamIdleTimeout))
+	return r.conn.Read(p)
 }
\ No newline at end of file
@@ -0,0 +1,32 @@
+package server
+
+import (
+	"os"
+	"strings"
+
+	"github.com/heysubinoy/ngopen/protocol"
+)
+
+// Edge header rules applied to every tunnel: request rules before a request
+// enters the tunnel, response rules before a response reaches the visitor.
+var (
+	requestHeaderRules  = headerRulesFromEnv("NGOPEN_REQUEST_HEADERS")
+	responseHeaderRules = headerRulesFromEnv("NGOPEN_RESPONSE_HEADERS")
+)
+
+// headerRulesFromEnv reads one rule per line. Lines rather than commas
+// separate rules because values such as "GET, POST" contain commas.
+func headerRulesFromEnv(name string) []protocol.HeaderRule {
+	var specs []string
+	for _, line := range strings.Split(os.Getenv(name), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			specs = append(specs, line)
+		}
+	}
+	rules, err := protocol.ParseHeaderRules(specs)
+	if err != nil {
+		LogError("Invalid %s: %v, ignoring it", name, err)
+		return nil
+	}
+	return rules
+}
@@ -0,0 +1,425 @@
+package server
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	oidcCallbackPath  = "/_ngopen/oidc/callback"
+	oidcSessionCookie = "_ngopen_session"
+	oidcStateCookie   = "_ngopen_state"
+	oidcSessionTTL    = 12 * time.Hour
+)
+
+// OIDCProvider logs visitors in with an OpenID Connect identity provider
+// using the authorization-code flow.
+type OIDCProvider struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	HTTPClient   *http.Client
+
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+	keys      map[string]*rsa.PublicKey
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type oidcState struct {
+	Host   string `json:"h"`
+	Return string `json:"r"`
+	Nonce  string `json:"n"`
+	Expiry int64  `json:"e"`
+}
+
+type oidcSession struct {
+	Email  string `json:"email"`
+	Host   string `json:"h"`
+	Expiry int64  `json:"e"`
+}
+
+type oidcClaims struct {
+	Issuer        string      `json:"iss"`
+	Audience      interface{} `json:"aud"`
+	Expiry        int64       `json:"exp"`
+	Nonce         string      `json:"nonce"`
+	Email         string      `json:"email"`
+	EmailVerified *bool       `json:"email_verified"`
+}
+
+var oidc = NewOIDCProviderFromEnv()
+
+// NewOIDCProviderFromEnv returns nil when no identity provider is configured.
+func NewOIDCProviderFromEnv() *OIDCProvider {
+	issuer := os.Getenv("NGOPEN_OIDC_ISSUER")
+	if issuer == "" {
+		return nil
+	}
+	return &OIDCProvider{
+		Issuer:       strings.TrimSuffix(issuer, "/"),
+		ClientID:     os.Getenv("NGOPEN_OIDC_CLIENT_ID"),
+		ClientSecret: os.Getenv("NGOPEN_OIDC_CLIENT_SECRET"),
+		HTTPClient:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (p *OIDCProvider) getDiscovery() (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+	resp, err := p.HTTPClient.Get(p.Issuer + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("discovery returned %s", resp.Status)
+	}
+	var d oidcDiscovery
+	if err := json.NewDecoder(resp.Body).Decode(&d); err != nil {
+		return nil, err
+	}
+	p.discovery = &d
+	return p.discovery, nil
+}
+
+// publicKey returns the signing key with the given id, refetching the JWKS
+// once if the provider has rotated keys.
+func (p *OIDCProvider) publicKey(kid string) (*rsa.PublicKey, error) {
+	p.mu.Lock()
+	key, ok := p.keys[kid]
+	p.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+	d, err := p.getDiscovery()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := p.HTTPClient.Get(d.JWKSURI)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var jwks struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&jwks); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	p.mu.Lock()
+	p.keys = keys
+	p.mu.Unlock()
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// exchange trades an authorization code for an ID token and returns its
+// verified claims.
+func (p *OIDCProvider) exchange(code, redirectURI, nonce string) (*oidcClaims, error) {
+	d, err := p.getDiscovery()
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirectURI},
+		"client_id":     {p.ClientID},
+		"client_secret": {p.ClientSecret},
+	}
+	resp, err := p.HTTPClient.PostForm(d.TokenEndpoint, form)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token endpoint returned %s", resp.Status)
+	}
+	var tok struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tok); err != nil {
+		return nil, err
+	}
+	claims, err := p.verifyIDToken(tok.IDToken)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Nonce != nonce {
+		return nil, errors.New("nonce mismatch")
+	}
+	return claims, nil
+}
+
+func (p *OIDCProvider) verifyIDToken(raw string) (*oidcClaims, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed id_token")
+	}
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return nil, err
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("unsupported id_token algorithm %q", header.Alg)
+	}
+	key, err := p.publicKey(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+		return nil, errors.New("bad id_token signature")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	var claims oidcClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, err
+	}
+	d, _ := p.getDiscovery()
+	if claims.Issuer != d.Issuer {
+		return nil, fmt.Errorf("unexpected issuer %q", claims.Issuer)
+	}
+	if !audienceContains(claims.Audience, p.ClientID) {
+		return nil, errors.New("id_token not issued for this client")
+	}
+	if time.Now().Unix() > claims.Expiry {
+		return nil, errors.New("id_token expired")
+	}
+	if claims.Email == "" || (claims.EmailVerified != nil && !*claims.EmailVerified) {
+		return nil, errors.New("id_token has no verified email")
+	}
+	return &claims, nil
+}
+
+func audienceContains(aud interface{}, clientID string) bool {
+	switch a := aud.(type) {
+	case string:
+		return a == clientID
+	case []interface{}:
+		for _, v := range a {
+			if s, ok := v.(string); ok && s == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// oidcAllowed reports whether email may access the tunnel.
+func oidcAllowed(client *Client, email string) bool {
+	email = strings.ToLower(email)
+	for _, e := range client.OIDCEmails {
+		if strings.ToLower(e) == email {
+			return true
+		}
+	}
+	_, domain, _ := strings.Cut(email, "@")
+	for _, d := range client.OIDCDomains {
+		if strings.ToLower(d) == domain {
+			return true
+		}
+	}
+	return false
+}
+
+// requestScheme guesses the scheme the visitor used; production sits behind
+// a TLS-terminating reverse proxy. X-Forwarded-Proto is only believed from
+// trusted peers.
+func requestScheme(r *http.Request) string {
+	if r.TLS != nil {
+		return "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" && trustedPeer(r) {
+		proto, _, _ = strings.Cut(proto, ",")
+		return strings.TrimSpace(proto)
+	}
+	if os.Getenv("NGOPEN_MODE") == "DEV" {
+		return "http"
+	}
+	return "https"
+}
+
+// oidcGate lets the request through if the visitor has a valid session for
+// this tunnel. Otherwise it starts the login flow or handles its callback and
+// returns false.
+func oidcGate(w http.ResponseWriter, r *http.Request, client *Client) bool {
+	if oidc == nil {
+		renderError(w, r, http.StatusServiceUnavailable, errorLoginUnavailable, "Login is not configured on this server")
+		return false
+	}
+	host := normalizeDomain(r.Host)
+	redirectURI := requestScheme(r) + "://" + r.Host + oidcCallbackPath
+
+	if r.URL.Path == oidcCallbackPath {
+		oidcCallback(w, r, client, host, redirectURI)
+		return false
+	}
+
+	if c, err := r.Cookie(oidcSessionCookie); err == nil {
+		var sess oidcSession
+		if verifyValue(c.Value, &sess) == nil && sess.Host == host &&
+			time.Now().Unix() < sess.Expiry && oidcAllowed(client, sess.Email) {
+			stripCookie(r, oidcSessionCookie)
+			return true
+		}
+	}
+
+	d, err := oidc.getDiscovery()
+	if err != nil {
+		LogError("OIDC discovery failed: %v", err)
+		renderError(w, r, http.StatusBadGateway, errorLoginUnavailable, "")
+		return false
+	}
+	state := oidcState{
+		Host:   host,
+		Return: r.URL.RequestURI(),
+		Nonce:  randomToken(),
+		Expiry: time.Now().Add(10 * time.Minute).Unix(),
+	}
+	signedState, err := signValue(state)
+	if err != nil {
+		renderError(w, r, http.StatusInternalServerError, errorInternal, "")
+		return false
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state.Nonce,
+		Path:     oidcCallbackPath,
+		MaxAge:   600,
+		HttpOnly: true,
+		Secure:   requestScheme(r) == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+	authURL := d.AuthorizationEndpoint + "?" + url.Values{
+		"response_type": {"code"},
+		"client_id":     {oidc.ClientID},
+		"redirect_uri":  {redirectURI},
+		"scope":         {"openid email"},
+		"state":         {signedState},
+		"nonce":         {state.Nonce},
+	}.Encode()
+	http.Redirect(w, r, authURL, http.StatusFound)
+	return false
+}
+
+func oidcCallback(w http.ResponseWriter, r *http.Request, client *Client, host, redirectURI string) {
+	var state oidcState
+	if err := verifyValue(r.URL.Query().Get("state"), &state); err != nil ||
+		state.Host != host || time.Now().Unix() > state.Expiry {
+		renderError(w, r, http.StatusBadRequest, errorBadRequest, "Invalid or expired login attempt, please try again")
+		return
+	}
+	if c, err := r.Cookie(oidcStateCookie); err != nil || c.Value != state.Nonce {
+		renderError(w, r, http.StatusBadRequest, errorBadRequest, "Invalid or expired login attempt, please try again")
+		return
+	}
+	claims, err := oidc.exchange(r.URL.Query().Get("code"), redirectURI, state.Nonce)
+	if err != nil {
+		LogWarn("OIDC login for '%s' failed: %v", host, err)
+		renderError(w, r, http.StatusUnauthorized, errorUnauthorized, "Login failed")
+		return
+	}
+	if !oidcAllowed(client, claims.Email) {
+		LogInfo("OIDC user '%s' denied access to '%s'", claims.Email, host)
+		renderError(w, r, http.StatusForbidden, errorForbidden, "")
+		return
+	}
+	session, err := signValue(oidcSession{
+		Email:  claims.Email,
+		Host:   host,
+		Expiry: time.Now().Add(oidcSessionTTL).Unix(),
+	})
+	if err != nil {
+		renderError(w, r, http.StatusInternalServerError, errorInternal, "")
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcSessionCookie,
+		Value:    session,
+		Path:     "/",
+		MaxAge:   int(oidcSessionTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   requestScheme(r) == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: oidcCallbackPath, MaxAge: -1})
+	if !strings.HasPrefix(state.Return, "/") || strings.HasPrefix(state.Return, "//") {
+		state.Return = "/"
+	}
+	http.Redirect(w, r, state.Return, http.StatusFound)
+}
+
+// stripCookie removes a single cookie from the request so edge credentials
+// are not forwarded to the local service.
+func stripCookie(r *http.Request, name string) {
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	for _, c := range cookies {
+		if c.Name != name {
+			r.AddCookie(c)
+		}
+	}
+}
@@ -0,0 +1,328 @@
+package server
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testTunnelHost = "demo.n.sbn.lol"
+
+// mockIssuer is a minimal OpenID Connect provider. The token endpoint hands
+// out an ID token built from claims, signed with key.
+type mockIssuer struct {
+	*httptest.Server
+	key    *rsa.PrivateKey
+	claims map[string]interface{}
+	codes  []string // codes presented to the token endpoint
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mockIssuer{key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcDiscovery{
+			Issuer:                m.URL,
+			AuthorizationEndpoint: m.URL + "/authorize",
+			TokenEndpoint:         m.URL + "/token",
+			JWKSURI:               m.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kid": "k1",
+			"kty": "RSA",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("client_id") != "ngopen" || r.Form.Get("client_secret") != "secret" {
+			http.Error(w, "bad client", http.StatusUnauthorized)
+			return
+		}
+		m.codes = append(m.codes, r.Form.Get("code"))
+		json.NewEncoder(w).Encode(map[string]string{"id_token": m.sign(t, m.key, m.claims)})
+	})
+	m.Server = httptest.NewServer(mux)
+	t.Cleanup(m.Close)
+
+	saved := oidc
+	oidc = &OIDCProvider{Issuer: m.URL, ClientID: "ngopen", ClientSecret: "secret", HTTPClient: m.Client()}
+	t.Cleanup(func() { oidc = saved })
+	return m
+}
+
+func (m *mockIssuer) sign(t *testing.T, key *rsa.PrivateKey, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "k1"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// validClaims returns claims the gate accepts for nonce.
+func (m *mockIssuer) validClaims(nonce string) map[string]interface{} {
+	return map[string]interface{}{
+		"iss":   m.URL,
+		"aud":   "ngopen",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"nonce": nonce,
+		"email": "ann@example.com",
+	}
+}
+
+func testOIDCClient() *Client {
+	return &Client{Name: testTunnelHost, OIDCEmails: []string{"ann@example.com"}}
+}
+
+// gate runs oidcGate for a request to path with the given cookies.
+func gate(t *testing.T, client *Client, path string, cookies ...*http.Cookie) (*httptest.ResponseRecorder, *http.Request, bool) {
+	r := httptest.NewRequest(http.MethodGet, "http://"+testTunnelHost+path, nil)
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	w := httptest.NewRecorder()
+	ok := oidcGate(w, r, client)
+	return w, r, ok
+}
+
+func cookieNamed(w *httptest.ResponseRecorder, name string) *http.Cookie {
+	for _, c := range w.Result().Cookies() {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// startLogin requests a protected page and returns the state and nonce the
+// gate sent to the provider, plus the state cookie.
+func startLogin(t *testing.T, m *mockIssuer, client *Client) (state, nonce string, stateCookie *http.Cookie) {
+	w, _, ok := gate(t, client, "/private?x=1")
+	if ok || w.Code != http.StatusFound {
+		t.Fatalf("unauthenticated request: ok=%v status=%d, want a redirect", ok, w.Code)
+	}
+	loc, err := url.Parse(w.Header().Get("Location"))
+	if err != nil || !strings.HasPrefix(loc.String(), m.URL+"/authorize") {
+		t.Fatalf("redirected to %q, want the provider", w.Header().Get("Location"))
+	}
+	q := loc.Query()
+	if q.Get("redirect_uri") != "https://"+testTunnelHost+oidcCallbackPath {
+		t.Fatalf("redirect_uri = %q", q.Get("redirect_uri"))
+	}
+	stateCookie = cookieNamed(w, oidcStateCookie)
+	if stateCookie == nil || stateCookie.Value != q.Get("nonce") {
+		t.Fatalf("state cookie %v does not carry the nonce %q", stateCookie, q.Get("nonce"))
+	}
+	return q.Get("state"), q.Get("nonce"), stateCookie
+}
+
+func callback(t *testing.T, client *Client, state string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	w, _, ok := gate(t, client, oidcCallbackPath+"?"+url.Values{"state": {state}, "code": {"abc"}}.Encode(), cookies...)
+	if ok {
+		t.Fatal("the callback itself was let through to the tunnel")
+	}
+	return w
+}
+
+func TestOIDCLoginFlow(t *testing.T) {
+	m := newMockIssuer(t)
+	client := testOIDCClient()
+
+	state, nonce, stateCookie := startLogin(t, m, client)
+	m.claims = m.validClaims(nonce)
+	w := callback(t, client, state, stateCookie)
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/private?x=1" {
+		t.Fatalf("callback: status=%d location=%q, want a redirect back", w.Code, w.Header().Get("Location"))
+	}
+	if len(m.codes) != 1 || m.codes[0] != "abc" {
+		t.Fatalf("token endpoint saw codes %v", m.codes)
+	}
+	session := cookieNamed(w, oidcSessionCookie)
+	if session == nil {
+		t.Fatal("no session cookie after login")
+	}
+
+	_, r, ok := gate(t, client, "/private", session, &http.Cookie{Name: "app", Value: "1"})
+	if !ok {
+		t.Fatal("request with a valid session was not let through")
+	}
+	if _, err := r.Cookie(oidcSessionCookie); err == nil {
+		t.Fatal("session cookie forwarded to the local service")
+	}
+	if c, err := r.Cookie("app"); err != nil || c.Value != "1" {
+		t.Fatal("other cookies were not forwarded")
+	}
+}
+
+func TestOIDCCallbackRejects(t *testing.T) {
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		// prepare sets the issuer's claims and may alter the state and cookie.
+		prepare func(m *mockIssuer, nonce string, state *string, cookie **http.Cookie)
+		status  int
+	}{
+		{
+			name: "tampered state",
+			prepare: func(m *mockIssuer, nonce string, state *string, _ **http.Cookie) {
+				m.claims = m.validClaims(nonce)
+				*state = strings.Replace(*state, ".", "x.", 1)
+			},
+			status: http.StatusBadRequest,
+		},
+		{
+			name: "missing state cookie",
+			prepare: func(m *mockIssuer, nonce string, _ *string, cookie **http.Cookie) {
+				m.claims = m.validClaims(nonce)
+				*cookie = nil
+			},
+			status: http.StatusBadRequest,
+		},
+		{
+			name: "state cookie from another login",
+			prepare: func(m *mockIssuer, nonce string, _ *string, cookie **http.Cookie) {
+				m.claims = m.validClaims(nonce)
+				*cookie = &http.Cookie{Name: oidcStateCookie, Value: "other"}
+			},
+			status: http.StatusBadRequest,
+		},
+		{
+			name: "nonce mismatch",
+			prepare: func(m *mockIssuer, nonce string, _ *string, _ **http.Cookie) {
+				m.claims = m.validClaims("replayed")
+			},
+			status: http.StatusUnauthorized,
+		},
+		{
+			name: "wrong audience",
+			prepare: func(m *mockIssuer, nonce string, _ *string, _ **http.Cookie) {
+				m.claims = m.validClaims(nonce)
+				m.claims["aud"] = []string{"someone-else"}
+			},
+			status: http.StatusUnauthorized,
+		},
+		{
+			name: "wrong issuer",
+			prepare: func(m *mockIssuer, nonce string, _ *string, _ **http.Cookie) {
+				m.claims = m.validClaims(nonce)
+				m.claims["iss"] = "https://evil.example"
+			},
+			status: http.StatusUnauthorized,
+		},
+		{
+			name: "expired token",
+			prepare: func(m *mockIssuer, nonce string, _ *string, _ **http.Cookie) {
+				m.claims = m.validClaims(nonce)
+				m.claims["exp"] = time.Now().Add(-time.Minute).Unix()
+			},
+			status: http.StatusUnauthorized,
+		},
+		{
+			name: "unverified email",
+			prepare: func(m *mockIssuer, nonce string, _ *string, _ **http.Cookie) {
+				m.claims = m.validClaims(nonce)
+				m.claims["email_verified"] = false
+			},
+			status: http.StatusUnauthorized,
+		},
+		{
+			name: "signed by another key",
+			prepare: func(m *mockIssuer, nonce string, _ *string, _ **http.Cookie) {
+				m.claims = m.validClaims(nonce)
+				m.key = otherKey
+			},
+			status: http.StatusUnauthorized,
+		},
+		{
+			name: "email not allowed",
+			prepare: func(m *mockIssuer, nonce string, _ *string, _ **http.Cookie) {
+				m.claims = m.validClaims(nonce)
+				m.claims["email"] = "bob@example.com"
+			},
+			status: http.StatusForbidden,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newMockIssuer(t)
+			client := testOIDCClient()
+			state, nonce, stateCookie := startLogin(t, m, client)
+			tt.prepare(m, nonce, &state, &stateCookie)
+			var cookies []*http.Cookie
+			if stateCookie != nil {
+				cookies = append(cookies, stateCookie)
+			}
+			w := callback(t, client, state, cookies...)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d", w.Code, tt.status)
+			}
+			if cookieNamed(w, oidcSessionCookie) != nil {
+				t.Fatal("session cookie issued for a rejected login")
+			}
+		})
+	}
+}
+
+func TestOIDCSessionCookie(t *testing.T) {
+	newMockIssuer(t)
+	valid := oidcSession{Email: "ann@example.com", Host: testTunnelHost, Expiry: time.Now().Add(time.Hour).Unix()}
+	sign := func(s oidcSession) string {
+		v, err := signValue(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	withHost, expired, otherUser := valid, valid, valid
+	withHost.Host = "other.n.sbn.lol"
+	expired.Expiry = time.Now().Add(-time.Minute).Unix()
+	otherUser.Email = "bob@example.com"
+
+	tests := []struct {
+		name  string
+		value string
+		ok    bool
+	}{
+		{"valid", sign(valid), true},
+		{"tampered", strings.Replace(sign(valid), ".", "A.", 1), false},
+		{"unsigned", base64.RawURLEncoding.EncodeToString([]byte(`{"email":"ann@example.com"}`)), false},
+		{"other tunnel", sign(withHost), false},
+		{"expired", sign(expired), false},
+		{"email no longer allowed", sign(otherUser), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, _, ok := gate(t, testOIDCClient(), "/", &http.Cookie{Name: oidcSessionCookie, Value: tt.value})
+			if ok != tt.ok {
+				t.Fatalf("let through = %v, want %v", ok, tt.ok)
+			}
+			if !ok && w.Code != http.StatusFound {
+				t.Fatalf("rejected session: status %d, want a redirect to log in", w.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,203 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Listeners that expect HAProxy PROXY protocol headers, configured with
+// NGOPEN_PROXY_PROTOCOL as a comma-separated list of http, https and tunnel.
+// Headers are only believed from NGOPEN_TRUSTED_PROXIES, which must be set.
+var proxyProtocolListeners = parseProxyProtocolListeners(splitEnvList("NGOPEN_PROXY_PROTOCOL"))
+
+const proxyHeaderTimeout = 5 * time.Second
+
+// proxyV2Signature starts every PROXY protocol v2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+func parseProxyProtocolListeners(names []string) map[string]bool {
+	listeners := make(map[string]bool)
+	for _, name := range names {
+		switch name = strings.ToLower(name); name {
+		case "http", "https", "tunnel":
+			listeners[name] = true
+		default:
+			LogError("Invalid NGOPEN_PROXY_PROTOCOL listener %q, expected http, https or tunnel", name)
+		}
+	}
+	return listeners
+}
+
+// listen opens a TCP listener, reading PROXY protocol headers if they are
+// enabled for the listener called name.
+func listen(name, addr string) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil || !proxyProtocolListeners[name] {
+		return ln, err
+	}
+	if len(trustedProxies) == 0 {
+		// Otherwise anyone who can reach the port could claim any address.
+		LogError("NGOPEN_PROXY_PROTOCOL needs NGOPEN_TRUSTED_PROXIES, not accepting PROXY protocol on the %s listener", name)
+		return ln, nil
+	}
+	LogInfo("Accepting PROXY protocol on the %s listener", name)
+	return &proxyListener{Listener: ln}, nil
+}
+
+// proxyListener wraps accepted connections so their RemoteAddr is the one
+// from the PROXY header.
+type proxyListener struct {
+	net.Listener
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: c}, nil
+}
+
+// proxyConn reads the PROXY header on first use rather than in Accept, so a
+// slow peer cannot hold up other connections.
+type proxyConn struct {
+	net.Conn
+	once   sync.Once
+	r      *bufio.Reader
+	remote net.Addr
+	err    error
+}
+
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		c.r = bufio.NewReader(c.Conn)
+		c.remote = c.Conn.RemoteAddr()
+		if ip := addrIP(c.remote); ip == nil || !containsIP(trustedProxies, ip) {
+			return
+		}
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		defer c.Conn.SetReadDeadline(time.Time{})
+		addr, err := readProxyHeader(c.r)
+		if err != nil {
+			LogWarn("Bad PROXY protocol header from %v: %v", c.remote, err)
+			c.err = err
+			return
+		}
+		if addr != nil {
+			c.remote = addr
+		}
+	})
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(p)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.init()
+	return c.remote
+}
+
+func addrIP(addr net.Addr) net.IP {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return tcp.IP
+	}
+	return nil
+}
+
+// readProxyHeader consumes a v1 or v2 header if r starts with one. It
+// returns the client address, or nil when there is no header or it carries
+// no address (health checks send LOCAL or UNKNOWN).
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, nil
+	}
+	switch first[0] {
+	case 'P':
+		if sig, _ := r.Peek(6); string(sig) == "PROXY " {
+			return readProxyV1(r)
+		}
+	case '\r':
+		if sig, _ := r.Peek(len(proxyV2Signature)); bytes.Equal(sig, proxyV2Signature) {
+			return readProxyV2(r)
+		}
+	}
+	return nil, nil
+}
+
+// readProxyV1 parses "PROXY TCP4 src dst sport dport\r\n".
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("v1 header too long or not terminated")
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed v1 header %q", strings.TrimSpace(string(line)))
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("malformed v1 source %s:%s", fields[2], fields[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// readProxyV2 parses the binary header, skipping any TLVs.
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported v2 version %d", header[12]>>4)
+	}
+	command, family := header[12]&0x0f, header[13]
+	body := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	if command == 0 { // LOCAL
+		return nil, nil
+	}
+	switch family >> 4 {
+	case 1: // IPv4
+		if len(body) < 12 {
+			return nil, errors.New("short v2 IPv4 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case 2: // IPv6
+		if len(body) < 36 {
+			return nil, errors.New("short v2 IPv6 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	}
+	return nil, nil
+}
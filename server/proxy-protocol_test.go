@@ -0,0 +1,89 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"strings"
+	"testing"
+)
+
+// proxyV2 builds a v2 header with the given command, family and address
+// block, followed by payload.
+func proxyV2(command, family byte, block []byte, payload string) string {
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, 0x20|command, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(block)))
+	return string(append(header, block...)) + payload
+}
+
+// v2Block is an address block with the given source address and port,
+// followed by extra bytes of TLVs.
+func v2Block(src []byte, port uint16, extra int) []byte {
+	block := append([]byte{}, src...)
+	block = append(block, make([]byte, len(src))...) // destination address
+	block = binary.BigEndian.AppendUint16(block, port)
+	block = binary.BigEndian.AppendUint16(block, 443)
+	return append(block, make([]byte, extra)...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	ipv6 := []byte{0x20, 0x01, 0x0d, 0xb8, 15: 1}
+	tests := []struct {
+		name  string
+		input string
+		addr  string // "" when no address is expected
+		err   string // "" when no error is expected
+	}{
+		{name: "no header", input: "GET / HTTP/1.1\r\n"},
+		{name: "empty connection", input: ""},
+		{name: "v1 TCP4", input: "PROXY TCP4 203.0.113.7 10.0.0.1 51234 443\r\nGET / HTTP/1.1\r\n", addr: "203.0.113.7:51234"},
+		{name: "v1 TCP6", input: "PROXY TCP6 2001:db8::1 2001:db8::2 51234 443\r\nGET / HTTP/1.1\r\n", addr: "[2001:db8::1]:51234"},
+		{name: "v1 UNKNOWN", input: "PROXY UNKNOWN\r\nGET / HTTP/1.1\r\n"},
+		{name: "v1 UNKNOWN with addresses", input: "PROXY UNKNOWN ffff:f::1 ffff:f::2 1 2\r\nGET / HTTP/1.1\r\n"},
+		{name: "v1 truncated", input: "PROXY TCP4 203.0.113.7 10.0", err: "EOF"},
+		{name: "v1 without CR", input: "PROXY TCP4 203.0.113.7 10.0.0.1 51234 443\nGET / HTTP/1.1\r\n", err: "not terminated"},
+		{name: "v1 too long", input: "PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n", err: "too long"},
+		{name: "v1 missing port", input: "PROXY TCP4 203.0.113.7 10.0.0.1 51234\r\n", err: "malformed v1 header"},
+		{name: "v1 unknown protocol", input: "PROXY UDP4 203.0.113.7 10.0.0.1 51234 443\r\n", err: "malformed v1 header"},
+		{name: "v1 bad address", input: "PROXY TCP4 not-an-ip 10.0.0.1 51234 443\r\n", err: "malformed v1 source"},
+		{name: "v1 port out of range", input: "PROXY TCP4 203.0.113.7 10.0.0.1 70000 443\r\n", err: "malformed v1 source"},
+		{name: "v2 IPv4", input: proxyV2(1, 0x11, v2Block([]byte{203, 0, 113, 7}, 51234, 0), "GET / HTTP/1.1\r\n"), addr: "203.0.113.7:51234"},
+		{name: "v2 IPv6", input: proxyV2(1, 0x21, v2Block(ipv6, 51234, 0), "GET / HTTP/1.1\r\n"), addr: "[2001:db8::1]:51234"},
+		{name: "v2 with TLVs", input: proxyV2(1, 0x11, v2Block([]byte{203, 0, 113, 7}, 51234, 7), "GET / HTTP/1.1\r\n"), addr: "203.0.113.7:51234"},
+		{name: "v2 LOCAL", input: proxyV2(0, 0x11, v2Block([]byte{203, 0, 113, 7}, 51234, 0), "GET / HTTP/1.1\r\n")},
+		{name: "v2 UNSPEC", input: proxyV2(1, 0x00, nil, "GET / HTTP/1.1\r\n")},
+		{name: "v2 unix socket", input: proxyV2(1, 0x31, make([]byte, 216), "GET / HTTP/1.1\r\n")},
+		{name: "v2 truncated header", input: proxyV2(1, 0x11, nil, "")[:14], err: io.ErrUnexpectedEOF.Error()},
+		{name: "v2 truncated addresses", input: proxyV2(1, 0x11, v2Block([]byte{203, 0, 113, 7}, 51234, 0), "")[:20], err: io.ErrUnexpectedEOF.Error()},
+		{name: "v2 short IPv4 block", input: proxyV2(1, 0x11, []byte{203, 0, 113, 7}, "GET / HTTP/1.1\r\n"), err: "short v2 IPv4"},
+		{name: "v2 short IPv6 block", input: proxyV2(1, 0x21, v2Block([]byte{203, 0, 113, 7}, 51234, 0), "GET / HTTP/1.1\r\n"), err: "short v2 IPv6"},
+		{name: "v2 wrong version", input: string(append(append([]byte{}, proxyV2Signature...), 0x11, 0x11, 0, 0)), err: "unsupported v2 version"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReader(strings.NewReader(tt.input))
+			addr, err := readProxyHeader(r)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("readProxyHeader error = %v, want it to mention %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readProxyHeader: %v", err)
+			}
+			got := ""
+			if addr != nil {
+				got = addr.String()
+			}
+			if got != tt.addr {
+				t.Fatalf("address = %q, want %q", got, tt.addr)
+			}
+			// Whatever follows the header must be left for the protocol.
+			if rest, _ := io.ReadAll(r); tt.input != "" && string(rest) != "GET / HTTP/1.1\r\n" {
+				t.Fatalf("left %q after the header, want the request", rest)
+			}
+		})
+	}
+}
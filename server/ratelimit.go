@@ -0,0 +1,92 @@
+package server
+
+import (
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Limits applied to public traffic. A zero value disables that limit.
+var (
+	tunnelRateLimiter  = NewRateLimiter(envFloat("NGOPEN_RATE_TUNNEL", 0), envInt("NGOPEN_RATE_TUNNEL_BURST", 0))
+	ipRateLimiter      = NewRateLimiter(envFloat("NGOPEN_RATE_IP", 0), envInt("NGOPEN_RATE_IP_BURST", 0))
+	maxInflight        = int64(envInt("NGOPEN_MAX_INFLIGHT", 0))
+	maxTunnelsPerToken = envInt("NGOPEN_MAX_TUNNELS_PER_TOKEN", 0)
+)
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter keeps one token bucket per key, refilled at rate tokens per
+// second up to burst.
+type RateLimiter struct {
+	sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*tokenBucket
+}
+
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	if burst <= 0 {
+		burst = int(math.Ceil(rate))
+	}
+	return &RateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// Allow takes a token for key. When none is left it returns false and how
+// long until one becomes available.
+func (l *RateLimiter) Allow(key string) (bool, time.Duration) {
+	return l.AllowN(key, 1)
+}
+
+// AllowN is like Allow but takes n tokens at once.
+func (l *RateLimiter) AllowN(key string, n float64) (bool, time.Duration) {
+	if l.rate <= 0 {
+		return true, 0
+	}
+	l.Lock()
+	defer l.Unlock()
+	now := time.Now()
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) > 10000 {
+			l.prune(now)
+		}
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens >= n {
+		b.tokens -= n
+		return true, 0
+	}
+	wait := time.Duration((n - b.tokens) / l.rate * float64(time.Second))
+	return false, wait
+}
+
+// prune drops buckets that have refilled completely; they behave the same as
+// a fresh bucket.
+func (l *RateLimiter) prune(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// retryAfterSeconds formats a wait for the Retry-After header, rounding up.
+func retryAfterSeconds(wait time.Duration) string {
+	secs := int(math.Ceil(wait.Seconds()))
+	if secs < 1 {
+		secs = 1
+	}
+	return strconv.Itoa(secs)
+}
@@ -1,50 +1,331 @@
 package server
 
 import (
+	"errors"
 	"log"
 	"net"
+	"slices"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/heysubinoy/ngopen/protocol"
 	"github.com/xtaci/smux"
 )
 
 type Client struct {
-	Conn    net.Conn
-	Session *smux.Session
-	Name    string
+	Conn        net.Conn
+	Session     *smux.Session
+	ID          string // unique per connection, used for sticky pool routing
+	Name        string
+	Pool        string // pool strategy if the client shares Name with others
+	UserID      string
+	TokenHash   string // fingerprint of the auth token used to connect
+	RemoteAddr  string
+	ConnectedAt time.Time
+	Domain      string // verified custom domain routed to this tunnel, if any
+	BasicAuth   string // "user:pass" required from visitors, if any
+	// Visitors must log in via OIDC with one of these emails or domains.
+	OIDCEmails  []string
+	OIDCDomains []string
+	AllowNets   []*net.IPNet
+	DenyNets    []*net.IPNet
+
+	Control *protocol.ControlConn // control stream, set once the client opens it
+
+	// Store state created by the handshake, dropped again if the tunnel
+	// never comes up.
+	newReservation bool
+	resumeHash     string
+
+	inflight atomic.Int64 // requests currently being proxied
+	down     atomic.Bool  // the client reports its local service is down
+}
+
+// Notify sends a control message to the client over its control stream.
+func (c *Client) Notify(msg protocol.ControlMessage) {
+	if c.Control == nil {
+		return
+	}
+	if err := c.Control.Send(msg); err != nil {
+		LogError("Failed to send control message to '%s': %v", c.Name, err)
+	}
+}
+
+// Disconnect tells the client why it is being dropped and closes its session.
+// Clients do not reconnect after a DISCONNECT.
+func (c *Client) Disconnect(reason string) {
+	c.Notify(protocol.ControlMessage{Type: protocol.ControlDisconnect, Reason: reason})
+	c.Session.Close()
+}
+
+// SetHealth records the local service health reported by the client.
+func (c *Client) SetHealth(msg protocol.ControlMessage) {
+	down := msg.Status == protocol.HealthDown
+	if c.down.Swap(down) == down {
+		return
+	}
+	if down {
+		LogInfo("Tunnel '%s' reports its local service is down: %s", c.Name, msg.Reason)
+	} else {
+		LogInfo("Tunnel '%s' reports its local service is up", c.Name)
+	}
+}
+
+// Healthy reports whether the client's local service is believed to be up.
+func (c *Client) Healthy() bool {
+	return !c.down.Load()
+}
+
+// Acquire reserves an in-flight slot, failing if max are already in use.
+// A max of zero means unlimited.
+func (c *Client) Acquire(max int64) bool {
+	if n := c.inflight.Add(1); max > 0 && n > max {
+		c.inflight.Add(-1)
+		return false
+	}
+	return true
+}
+
+// Release frees a slot taken by Acquire.
+func (c *Client) Release() {
+	c.inflight.Add(-1)
 }
+
+// Inflight returns the number of requests currently being proxied.
+func (c *Client) Inflight() int64 {
+	return c.inflight.Load()
+}
+
+// AllowsIP applies the tunnel's allow and deny lists; deny wins.
+func (c *Client) AllowsIP(ip net.IP) bool {
+	if len(c.AllowNets) == 0 && len(c.DenyNets) == 0 {
+		return true
+	}
+	if ip == nil || containsIP(c.DenyNets, ip) {
+		return false
+	}
+	return len(c.AllowNets) == 0 || containsIP(c.AllowNets, ip)
+}
+
+// RequiresLogin reports whether visitors must log in via OIDC.
+func (c *Client) RequiresLogin() bool {
+	return len(c.OIDCEmails) > 0 || len(c.OIDCDomains) > 0
+}
+
+// tunnelPool holds every client registered under one hostname. Most pools
+// have a single member; clients that ask to pool share the hostname.
+type tunnelPool struct {
+	strategy string
+	members  []*Client
+	next     atomic.Uint64 // round-robin cursor, advanced under the read lock
+}
+
 type TunnelRegistry struct {
 	sync.RWMutex
-	clients map[string]*Client
+	pools map[string]*tunnelPool
 }
 
 func NewTunnelRegistry() *TunnelRegistry {
 	return &TunnelRegistry{
-		clients: make(map[string]*Client),
+		pools: make(map[string]*tunnelPool),
+	}
+}
+
+var (
+	errHostnameInUse = errors.New("hostname is already connected")
+	errPoolMismatch  = errors.New("pool members must use the same pool strategy, domain and visitor access rules")
+)
+
+// canJoin reports why client may not be registered alongside pool's members.
+// Only pooling clients of the same owner with identical visitor policy may
+// share a hostname, so no member is an easier way in than another.
+func canJoin(pool *tunnelPool, client *Client) error {
+	existing := pool.members[0]
+	if client.Pool == "" || existing.UserID != client.UserID {
+		return errHostnameInUse
+	}
+	if existing.Pool != client.Pool || existing.Domain != client.Domain ||
+		existing.BasicAuth != client.BasicAuth ||
+		!slices.Equal(existing.OIDCEmails, client.OIDCEmails) ||
+		!slices.Equal(existing.OIDCDomains, client.OIDCDomains) ||
+		!sameNets(existing.AllowNets, client.AllowNets) ||
+		!sameNets(existing.DenyNets, client.DenyNets) {
+		return errPoolMismatch
+	}
+	return nil
+}
+
+func sameNets(a, b []*net.IPNet) bool {
+	return slices.EqualFunc(a, b, func(x, y *net.IPNet) bool { return x.String() == y.String() })
+}
+
+// CanAdd reports whether Add would accept client under name right now.
+func (r *TunnelRegistry) CanAdd(name string, client *Client) error {
+	r.RLock()
+	defer r.RUnlock()
+	if pool, ok := r.pools[name]; ok {
+		return canJoin(pool, client)
 	}
+	return nil
 }
 
-func (r *TunnelRegistry) Add(name string, client *Client) {
+// Add registers client under name, joining the existing pool if there is
+// one. It fails if the pool belongs to someone else or has a different
+// policy.
+func (r *TunnelRegistry) Add(name string, client *Client) error {
 	r.Lock()
 	defer r.Unlock()
-	r.clients[name] = client
-	log.Printf("Tunnel client '%s' registered.", name)
+	pool, ok := r.pools[name]
+	if ok {
+		if err := canJoin(pool, client); err != nil {
+			return err
+		}
+	} else {
+		pool = &tunnelPool{strategy: client.Pool}
+		r.pools[name] = pool
+	}
+	client.ConnectedAt = time.Now()
+	pool.members = append(pool.members, client)
+	if len(pool.members) > 1 {
+		log.Printf("Tunnel client '%s' joined pool (%d members).", name, len(pool.members))
+	} else {
+		log.Printf("Tunnel client '%s' registered.", name)
+	}
+	events.Emit(clientEvent(EventTunnelConnected, client))
+	return nil
 }
 
+// Get returns a client registered under name. For pools it is the oldest
+// member; use Pick to spread requests.
 func (r *TunnelRegistry) Get(name string) (*Client, bool) {
 	r.RLock()
 	defer r.RUnlock()
-	client, ok := r.clients[name]
-	return client, ok
+	pool, ok := r.pools[name]
+	if !ok {
+		return nil, false
+	}
+	return pool.members[0], true
+}
+
+// Members returns a snapshot of the clients registered under name.
+func (r *TunnelRegistry) Members(name string) []*Client {
+	r.RLock()
+	defer r.RUnlock()
+	if pool, ok := r.pools[name]; ok {
+		return append([]*Client(nil), pool.members...)
+	}
+	return nil
 }
 
-func (r *TunnelRegistry) Remove(name string) {
+// Pick chooses the client that should serve a request for name. sticky is
+// the member ID remembered by the visitor, if any; it wins while that member
+// is still connected.
+func (r *TunnelRegistry) Pick(name, sticky string) (*Client, bool) {
+	r.RLock()
+	defer r.RUnlock()
+	pool, ok := r.pools[name]
+	if !ok {
+		return nil, false
+	}
+	if len(pool.members) == 1 {
+		return pool.members[0], true
+	}
+	// Skip members whose local service is down, unless they all are.
+	candidates := make([]*Client, 0, len(pool.members))
+	for _, c := range pool.members {
+		if c.Healthy() {
+			candidates = append(candidates, c)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = pool.members
+	}
+	if sticky != "" && pool.strategy == protocol.PoolSticky {
+		for _, c := range candidates {
+			if c.ID == sticky {
+				return c, true
+			}
+		}
+	}
+	start := int((pool.next.Add(1) - 1) % uint64(len(candidates)))
+	picked := candidates[start]
+	if pool.strategy == protocol.PoolLeastInflight {
+		// Scan from the round-robin position so ties are spread out.
+		for i := 1; i < len(candidates); i++ {
+			c := candidates[(start+i)%len(candidates)]
+			if c.Inflight() < picked.Inflight() {
+				picked = c
+			}
+		}
+	}
+	return picked, true
+}
+
+// List returns a snapshot of the connected clients.
+func (r *TunnelRegistry) List() []*Client {
+	r.RLock()
+	defer r.RUnlock()
+	clients := make([]*Client, 0, len(r.pools))
+	for _, pool := range r.pools {
+		clients = append(clients, pool.members...)
+	}
+	return clients
+}
+
+// CountByToken returns how many tunnels are connected with the given token.
+func (r *TunnelRegistry) CountByToken(tokenHash string) int {
+	r.RLock()
+	defer r.RUnlock()
+	n := 0
+	for _, pool := range r.pools {
+		for _, client := range pool.members {
+			if client.TokenHash == tokenHash {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// Remove closes client and takes it out of its pool. It returns how many
+// members are left under the client's hostname.
+func (r *TunnelRegistry) Remove(client *Client) int {
 	r.Lock()
-	defer r.Unlock()
-	if client, ok := r.clients[name]; ok {
-		client.Conn.Close()
-		client.Session.Close()
-		delete(r.clients, name)
-		log.Printf("Tunnel client '%s' unregistered.", name)
+	name := client.Name
+	pool, ok := r.pools[name]
+	if !ok {
+		r.Unlock()
+		return 0
+	}
+	i := slices.Index(pool.members, client)
+	if i < 0 {
+		r.Unlock()
+		return len(pool.members)
 	}
-}
\ No newline at end of file
+	pool.members = slices.Delete(pool.members, i, i+1)
+	left := len(pool.members)
+	if left == 0 {
+		delete(r.pools, name)
+	}
+	// Closing and recording history can block; keep it out of the lock so
+	// requests for other tunnels aren't held up.
+	r.Unlock()
+
+	client.Conn.Close()
+	client.Session.Close()
+	log.Printf("Tunnel client '%s' unregistered.", name)
+	events.Emit(clientEvent(EventTunnelDisconnected, client))
+	err := store.AppendHistory(TunnelHistory{
+		Hostname:       name,
+		UserID:         client.UserID,
+		Domain:         client.Domain,
+		RemoteAddr:     client.RemoteAddr,
+		ConnectedAt:    client.ConnectedAt,
+		DisconnectedAt: time.Now(),
+	})
+	if err != nil {
+		LogError("Failed to record tunnel history: %v", err)
+	}
+	return left
+}
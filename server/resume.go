@@ -0,0 +1,101 @@
+package server
+
+import (
+	"os"
+	"strings"
+	"time"
+)
+
+// resumeTTL bounds how long a client may come back for its hostname.
+const resumeTTL = 24 * time.Hour
+
+type resumeClaim struct {
+	Host   string `json:"h"`
+	User   string `json:"u"`
+	Expiry int64  `json:"e"`
+}
+
+// issueResumeSecret returns a secret that lets userID reclaim hostname after
+// reconnecting, including to a restarted server sharing NGOPEN_SESSION_SECRET.
+// The secret is also recorded in the store so older ones stop working.
+func issueResumeSecret(hostname, userID string) string {
+	secret, err := signValue(resumeClaim{
+		Host:   hostname,
+		User:   userID,
+		Expiry: time.Now().Add(resumeTTL).Unix(),
+	})
+	if err != nil {
+		LogError("Failed to issue resume secret: %v", err)
+		return ""
+	}
+	// Only the most recently issued secret for a hostname stays valid.
+	record := ResumeRecord{UserID: userID, SecretHash: hashSecret(secret), Expires: time.Now().Add(resumeTTL)}
+	if err := store.SaveResume(hostname, record); err != nil {
+		LogError("Failed to persist resume secret for '%s': %v", hostname, err)
+	}
+	return secret
+}
+
+// revokeResume stops every resume secret issued for hostname from working.
+// Dropping the record is not enough, since a signed secret with no record is
+// accepted (the record may have been lost with an in-memory store); an empty
+// hash is kept instead until any secret would have expired anyway.
+func revokeResume(hostname, userID string) {
+	record := ResumeRecord{UserID: userID, Expires: time.Now().Add(resumeTTL)}
+	if err := store.SaveResume(hostname, record); err != nil {
+		LogError("Failed to revoke resume secret for '%s': %v", hostname, err)
+	}
+}
+
+// checkResumeSecret reports whether secret was issued to userID for hostname.
+func checkResumeSecret(secret, hostname, userID string) bool {
+	var claim resumeClaim
+	if secret == "" || verifyValue(secret, &claim) != nil {
+		return false
+	}
+	if claim.Host != hostname || claim.User != userID || time.Now().Unix() >= claim.Expiry {
+		return false
+	}
+	if record, ok := store.Resume(hostname); ok && record.SecretHash != hashSecret(secret) {
+		return false
+	}
+	return true
+}
+
+// allowCustomHostnames lets users claim any free hostname under the suffix,
+// not just ones they held before.
+var allowCustomHostnames = os.Getenv("NGOPEN_ALLOW_CUSTOM_HOSTNAMES") == "true"
+
+// qualifyHostname appends the server's suffix to a bare subdomain.
+func qualifyHostname(hostname string) string {
+	hostname = strings.ToLower(hostname)
+	if !strings.Contains(hostname, ".") {
+		return hostname + hostnameSuffix
+	}
+	return hostname
+}
+
+// mayUseHostname decides whether userID may register a specific hostname
+// without a resume secret: when the hostname is reserved for them, or when
+// custom hostnames are allowed and nobody else has reserved it.
+func mayUseHostname(hostname, userID string) bool {
+	owner, reserved := store.Reservation(hostname)
+	if reserved {
+		return owner == userID
+	}
+	return allowCustomHostnames && strings.HasSuffix(hostname, hostnameSuffix) &&
+		validSubdomain(strings.TrimSuffix(hostname, hostnameSuffix))
+}
+
+// validSubdomain accepts a single DNS label.
+func validSubdomain(label string) bool {
+	if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+		return false
+	}
+	for _, ch := range label {
+		if !(ch >= 'a' && ch <= 'z' || ch >= '0' && ch <= '9' || ch == '-') {
+			return false
+		}
+	}
+	return true
+}
@@ -2,51 +2,258 @@
 package server
 
 import (
-	"encoding/binary"
+	"errors"
 	"io"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/heysubinoy/ngopen/protocol"
 
 	"github.com/xtaci/smux"
+	"golang.org/x/crypto/acme/autocert"
 )
 
-func authenticate(stream net.Conn) (string, bool) {
+var (
+	keepaliveInterval = envDuration("NGOPEN_KEEPALIVE_INTERVAL", 15*time.Second)
+	keepaliveTimeout  = envDuration("NGOPEN_KEEPALIVE_TIMEOUT", 45*time.Second)
+)
+
+const controlAcceptTimeout = 10 * time.Second
+
+func init() {
+	if keepaliveInterval <= 0 || keepaliveTimeout <= keepaliveInterval {
+		LogError("NGOPEN_KEEPALIVE_TIMEOUT must be longer than a positive NGOPEN_KEEPALIVE_INTERVAL, using defaults")
+		keepaliveInterval, keepaliveTimeout = 15*time.Second, 45*time.Second
+	}
+}
+
+// rejectAuth refuses a handshake, audits it and reports the failure as an
+// event. user is empty until the token has been validated.
+func rejectAuth(stream net.Conn, msg protocol.ProtocolAuthMessage, user string, resp protocol.ProtocolAuthResponse) {
+	protocol.SendAuthResponse(stream, resp)
+	entry := AuditEntry{
+		Action:     AuditAuthAttempt,
+		Actor:      "anonymous",
+		RemoteAddr: stream.RemoteAddr().String(),
+		Hostname:   msg.Hostname,
+		Reason:     resp.Code + ": " + resp.Reason,
+	}
+	if user != "" {
+		entry.Actor = user
+	}
+	if msg.AuthToken != "" {
+		entry.Token = TokenFingerprint(msg.AuthToken)
+	}
+	audit.Record(entry)
+	events.Emit(Event{
+		Type:       EventAuthFailed,
+		Hostname:   msg.Hostname,
+		RemoteAddr: stream.RemoteAddr().String(),
+		Reason:     resp.Code + ": " + resp.Reason,
+	})
+}
+
+// authenticate reads the client's auth message and answers it. On success it
+// returns a Client describing the tunnel; the caller fills in the connection.
+func authenticate(stream net.Conn, registry *TunnelRegistry) (*Client, bool) {
 	msg, err := protocol.DecodeProtocolAuthMessage(stream)
 	if err != nil {
 		LogError("Failed to decode auth message: %v", err)
-		return "", false
+		return nil, false
+	}
+	user := ValidateToken(msg.AuthToken)
+	if !user.Valid {
+		rejectAuth(stream, msg, "", protocol.ProtocolAuthResponse{Reason: "Invalid token", Code: protocol.ErrInvalidToken})
+		return nil, false
+	}
+	tokenHash := TokenFingerprint(msg.AuthToken)
+	// Ownership of pools, reservations and domains compares user IDs, so a
+	// token the API does not tie to a user owns them by itself rather than
+	// sharing the empty ID with every other such token.
+	if user.UserID == "" {
+		user.UserID = "token:" + tokenHash
+	}
+	if maxTunnelsPerToken > 0 && registry.CountByToken(tokenHash) >= maxTunnelsPerToken {
+		rejectAuth(stream, msg, user.UserID, protocol.ProtocolAuthResponse{Reason: "Too many tunnels for this token", Code: protocol.ErrTooManyTunnels})
+		return nil, false
 	}
-	if !IsValidToken(msg.AuthToken) {
-		resp := "FAIL:Invalid token"
-		respHeader := make([]byte, 4)
-		binary.BigEndian.PutUint32(respHeader, uint32(len(resp)))
-		stream.Write(append(respHeader, []byte(resp)...))
-		return "", false
+	if Draining() {
+		rejectAuth(stream, msg, user.UserID, protocol.ProtocolAuthResponse{Reason: "Server is shutting down", Code: protocol.ErrShuttingDown})
+		return nil, false
 	}
 	assigned := msg.Hostname
-	if assigned == "AUTO" || assigned == "" {
-		assigned = GenerateHostname()
+	requested := assigned != "AUTO" && assigned != ""
+	resumed := false
+	if !requested {
+		assigned = freeHostname(registry)
+	} else {
+		assigned = qualifyHostname(assigned)
+		resumed = checkResumeSecret(msg.Resume, assigned, user.UserID)
+		if !resumed && !mayUseHostname(assigned, user.UserID) {
+			rejectAuth(stream, msg, user.UserID, protocol.ProtocolAuthResponse{Reason: "Hostname is not allowed", Code: protocol.ErrHostnameDenied})
+			return nil, false
+		}
+	}
+	if msg.Pool != "" && !protocol.ValidPoolStrategy(msg.Pool) {
+		rejectAuth(stream, msg, user.UserID, protocol.ProtocolAuthResponse{Reason: "Unknown pool strategy " + msg.Pool, Code: protocol.ErrBadRequest})
+		return nil, false
+	}
+	if msg.Domain != "" {
+		// Only known domains are settled here; new ones are verified in
+		// the background once the tunnel is up.
+		if _, err := domains.Check(user.UserID, msg.Domain); err != nil {
+			LogWarn("Custom domain rejected: %v", err)
+			rejectAuth(stream, msg, user.UserID, protocol.ProtocolAuthResponse{Reason: err.Error(), Code: protocol.ErrDomainUnverified})
+			return nil, false
+		}
+	}
+	if msg.BasicAuth != "" && !strings.Contains(msg.BasicAuth, ":") {
+		rejectAuth(stream, msg, user.UserID, protocol.ProtocolAuthResponse{Reason: "Basic auth must be in user:pass form", Code: protocol.ErrBadRequest})
+		return nil, false
+	}
+	client := &Client{
+		ID:          randomToken(),
+		Name:        assigned,
+		Pool:        msg.Pool,
+		UserID:      user.UserID,
+		TokenHash:   tokenHash,
+		Domain:      msg.Domain,
+		BasicAuth:   msg.BasicAuth,
+		OIDCEmails:  msg.OIDCEmails,
+		OIDCDomains: msg.OIDCDomains,
+	}
+	if client.AllowNets, err = ParseCIDRList(msg.AllowCIDRs); err != nil {
+		rejectAuth(stream, msg, user.UserID, protocol.ProtocolAuthResponse{Reason: "Invalid allow CIDR: " + err.Error(), Code: protocol.ErrBadRequest})
+		return nil, false
+	}
+	if client.DenyNets, err = ParseCIDRList(msg.DenyCIDRs); err != nil {
+		rejectAuth(stream, msg, user.UserID, protocol.ProtocolAuthResponse{Reason: "Invalid deny CIDR: " + err.Error(), Code: protocol.ErrBadRequest})
+		return nil, false
+	}
+	if client.RequiresLogin() && oidc == nil {
+		rejectAuth(stream, msg, user.UserID, protocol.ProtocolAuthResponse{Reason: "OIDC login is not configured on this server", Code: protocol.ErrBadRequest})
+		return nil, false
+	}
+	// Add checks again under its lock; this gives the client a clear answer
+	// in the common case.
+	if err := registry.CanAdd(assigned, client); err != nil {
+		rejectAuth(stream, msg, user.UserID, poolRejection(err))
+		return nil, false
+	}
+	if cluster != nil {
+		if err := cluster.Claim(assigned, clusterSelf); err != nil {
+			LogWarn("Cluster claim failed: %v", err)
+			rejectAuth(stream, msg, user.UserID, protocol.ProtocolAuthResponse{Reason: "Hostname is already connected", Code: protocol.ErrHostnameInUse})
+			return nil, false
+		}
+	}
+	// Generated names are not reserved; the resume secret is enough to get
+	// one back. A resumed name is either reserved already or was generated.
+	if requested && !resumed {
+		_, reserved := store.Reservation(assigned)
+		if err := store.Reserve(assigned, user.UserID); err != nil {
+			LogError("Failed to reserve '%s': %v", assigned, err)
+			if _, taken := registry.Get(assigned); !taken && cluster != nil {
+				cluster.Release(assigned, clusterSelf)
+			}
+			rejectAuth(stream, msg, user.UserID, protocol.ProtocolAuthResponse{Reason: "Could not reserve hostname", Code: protocol.ErrServerError})
+			return nil, false
+		}
+		client.newReservation = !reserved
+	}
+	resume := issueResumeSecret(assigned, user.UserID)
+	if resume != "" {
+		client.resumeHash = hashSecret(resume)
+	}
+	protocol.SendAuthResponse(stream, protocol.ProtocolAuthResponse{
+		OK:       true,
+		Hostname: assigned,
+		Resume:   resume,
+	})
+	remote := stream.RemoteAddr().String()
+	audit.Record(AuditEntry{Action: AuditAuthAttempt, Actor: user.UserID, RemoteAddr: remote, Token: tokenHash, Hostname: msg.Hostname, Success: true})
+	audit.Record(AuditEntry{Action: AuditHostnameAssigned, Actor: user.UserID, RemoteAddr: remote, Token: tokenHash, Hostname: assigned, Success: true})
+	events.Emit(Event{
+		Type:       EventTunnelAuthenticated,
+		Hostname:   assigned,
+		UserID:     user.UserID,
+		Domain:     msg.Domain,
+		RemoteAddr: remote,
+	})
+	return client, true
+}
+
+// freeHostname generates a hostname that no live tunnel, reservation,
+// unexpired resume secret or cluster peer holds, so a recently disconnected
+// client can still come back for its name.
+func freeHostname(registry *TunnelRegistry) string {
+	for {
+		name := GenerateHostname()
+		if _, taken := registry.Get(name); taken {
+			continue
+		}
+		if _, reserved := store.Reservation(name); reserved {
+			continue
+		}
+		if record, ok := store.Resume(name); ok && time.Now().Before(record.Expires) {
+			continue
+		}
+		if cluster != nil {
+			if _, held := cluster.Owner(name); held {
+				continue
+			}
+		}
+		return name
+	}
+}
+
+// poolRejection turns an error from TunnelRegistry.Add into a handshake
+// failure.
+func poolRejection(err error) protocol.ProtocolAuthResponse {
+	if err == errHostnameInUse {
+		return protocol.ProtocolAuthResponse{Reason: "Hostname is already connected", Code: protocol.ErrHostnameInUse}
+	}
+	return protocol.ProtocolAuthResponse{Reason: "Pool members must use the same pool strategy, domain and access rules", Code: protocol.ErrBadRequest}
+}
+
+// releaseTunnel gives up client's hostname and domain once its session is
+// over, unless other pool members still hold them. live is false if the
+// tunnel never came up; then the reservation and resume secret created by
+// its handshake are dropped as well.
+func releaseTunnel(registry *TunnelRegistry, client *Client, live bool) {
+	if live {
+		if registry.Remove(client) > 0 {
+			return
+		}
 	} else {
-		resp := "FAIL: Hostname is not allowed"
-		respHeader := make([]byte, 4)
-		binary.BigEndian.PutUint32(respHeader, uint32(len(resp)))
-		stream.Write(append(respHeader, []byte(resp)...))
-		return "", false
-	}
-	resp := "OK:" + assigned
-	respHeader := make([]byte, 4)
-	binary.BigEndian.PutUint32(respHeader, uint32(len(resp)))
-	stream.Write(append(respHeader, []byte(resp)...))
-	return assigned, true
+		if client.newReservation {
+			if err := store.Unreserve(client.Name, client.UserID); err != nil {
+				LogError("Failed to drop reservation of '%s': %v", client.Name, err)
+			}
+		}
+		if client.resumeHash != "" {
+			if err := store.DropResume(client.Name, client.resumeHash); err != nil {
+				LogError("Failed to drop resume secret of '%s': %v", client.Name, err)
+			}
+		}
+		if _, taken := registry.Get(client.Name); taken {
+			return
+		}
+	}
+	if client.Domain != "" {
+		domains.unroute(client)
+	}
+	if cluster != nil {
+		cluster.Release(client.Name, clusterSelf)
+	}
 }
 
 func StartTunnelListener(registry *TunnelRegistry) {
-	ln, err := net.Listen("tcp", ":9000")
+	ln, err := listen("tunnel", ":9000")
 	if err != nil {
 		LogError("Tunnel listen error:", err)
 	}
@@ -72,46 +279,190 @@ func StartTunnelListener(registry *TunnelRegistry) {
 				session.Close()
 				return
 			}
-			assignedHostname, ok := authenticate(authStream)
+			client, ok := authenticate(authStream, registry)
 			authStream.Close()
 			if !ok {
 				LogError("Authentication failed, closing session")
 				session.Close()
 				return
 			}
-			client := &Client{
-				Conn:    c,
-				Session: session,
-				Name:    assignedHostname,
+			client.Conn = c
+			client.Session = session
+			client.RemoteAddr = c.RemoteAddr().String()
+			live := false
+			defer func() { releaseTunnel(registry, client, live) }()
+
+			// The client opens its control stream right after authenticating.
+			session.SetDeadline(time.Now().Add(controlAcceptTimeout))
+			controlStream, err := session.AcceptStream()
+			session.SetDeadline(time.Time{})
+			var timeout net.Error
+			switch {
+			case errors.As(err, &timeout) && timeout.Timeout():
+				// Clients from before the control stream never open one; keep
+				// serving them, without heartbeats or notices.
+				LogWarn("Tunnel client '%s' opened no control stream, serving it without heartbeats", client.Name)
+			case err != nil:
+				LogError("Failed to accept control stream from '%s': %v", client.Name, err)
+				session.Close()
+				return
+			default:
+				client.Control = protocol.NewControlConn(controlStream)
+			}
+			if client.Control != nil {
+				go func() {
+					err := client.Control.Run(keepaliveInterval, keepaliveTimeout, func(msg protocol.ControlMessage) {
+						if msg.Type == protocol.ControlHealth {
+							client.SetHealth(msg)
+						}
+					})
+					if err == protocol.ErrHeartbeatTimeout {
+						LogWarn("Tunnel client '%s' stopped answering heartbeats, disconnecting", client.Name)
+					}
+					session.Close()
+				}()
+			}
+			if err := registry.Add(client.Name, client); err != nil {
+				// Another client took the hostname since the handshake. This
+				// is not a DISCONNECT, which clients treat as final; the retry
+				// gets a proper handshake error instead.
+				LogWarn("Tunnel client '%s' rejected: %v", client.Name, err)
+				client.Notify(protocol.ControlMessage{Type: protocol.ControlNotice, Reason: poolRejection(err).Reason})
+				session.Close()
+				return
 			}
-			registry.Add(assignedHostname, client)
-			LogInfo("Tunnel client '%s' connected.", assignedHostname)
+			live = true
+			if client.Domain != "" && !domains.route(client) {
+				go domains.awaitVerification(client, session.CloseChan())
+			}
+			LogInfo("Tunnel client '%s' connected.", client.Name)
 			<-session.CloseChan()
-			registry.Remove(assignedHostname)
 		}(conn)
 	}
 }
 
-// startHTTPServer starts an HTTP server that, on each request, opens a new smux stream.
-func StartHTTPServer(registry *TunnelRegistry) {
-	devMode := os.Getenv("NGOPEN_MODE") == "DEV"
-	addr := ":8080"
-	if devMode {
-		addr = ":8080"
+// poolCookie pins a visitor to one member of a sticky hostname pool.
+const poolCookie = "_ngopen_member"
+
+func tooManyRequests(w http.ResponseWriter, r *http.Request, wait time.Duration) {
+	w.Header().Set("Retry-After", retryAfterSeconds(wait))
+	renderError(w, r, http.StatusTooManyRequests, errorRateLimited, "")
+}
+
+// tunnelFailed renders the page for a request that broke inside the tunnel,
+// telling timeouts apart from other failures.
+func tunnelFailed(w http.ResponseWriter, r *http.Request, err error) {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		renderError(w, r, http.StatusGatewayTimeout, errorTimeout, "")
+		return
 	}
+	renderError(w, r, http.StatusBadGateway, errorTunnelFailed, "")
+}
+
+// proxyHandler forwards public requests to the tunnel named by the Host
+// header, opening a new smux stream per request.
+func proxyHandler(registry *TunnelRegistry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get(requestIDHeader)
+		if requestID == "" || len(requestID) > 128 {
+			requestID = newRequestID()
+			r.Header.Set(requestIDHeader, requestID)
+		}
+		w.Header().Set(requestIDHeader, requestID)
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		target := r.Host
 		if target == "" {
-			http.Error(w, "Missing Host header", http.StatusBadRequest)
+			renderError(w, r, http.StatusBadRequest, errorBadRequest, "Missing Host header")
 			return
 		}
 
-		// Show the contents of static/error.html if tunnel client is not connected
-		tunnelClient, ok := registry.Get(target)
+		var sticky string
+		if c, err := r.Cookie(poolCookie); err == nil {
+			sticky = c.Value
+		}
+		tunnelClient, ok := registry.Pick(target, sticky)
 		if !ok {
-			w.Header().Set("Content-Type", "text/html; charset=utf-8")
-			http.ServeFile(w, r, "static/error.html")
+			// Custom domains are routed to the tunnel that owns them.
+			if name, found := domains.Lookup(target); found {
+				tunnelClient, ok = registry.Pick(name, sticky)
+			}
+		}
+		// The owner node needs the pool cookie to keep the visitor on the
+		// same member, so it is only stripped once the pick is ours.
+		if !ok && forwardToOwner(w, r, target) {
+			return
+		}
+		if !ok {
+			renderError(w, r, http.StatusNotFound, errorTunnelOffline, "")
+			return
+		}
+		if sticky != "" {
+			stripCookie(r, poolCookie)
+		}
+		if tunnelClient.Pool == protocol.PoolSticky && tunnelClient.ID != sticky {
+			http.SetCookie(w, &http.Cookie{
+				Name:     poolCookie,
+				Value:    tunnelClient.ID,
+				Path:     "/",
+				HttpOnly: true,
+				Secure:   requestScheme(r) == "https",
+				SameSite: http.SameSiteLaxMode,
+			})
+		}
+
+		ip := clientIP(r)
+		if !tunnelClient.AllowsIP(ip) {
+			LogInfo("Rejected visitor %v for '%s' by IP policy", ip, target)
+			renderError(w, r, http.StatusForbidden, errorForbidden, "")
+			return
+		}
+		if ok, wait := ipRateLimiter.Allow(ip.String()); !ok {
+			tooManyRequests(w, r, wait)
+			return
+		}
+
+		// Challenge visitors before anything reaches the client.
+		if tunnelClient.BasicAuth != "" {
+			if !checkBasicAuth(r, tunnelClient.BasicAuth) {
+				w.Header().Set("WWW-Authenticate", `Basic realm="ngopen", charset="UTF-8"`)
+				renderError(w, r, http.StatusUnauthorized, errorUnauthorized, "")
+				return
+			}
+			r.Header.Del("Authorization")
+		}
+		if tunnelClient.RequiresLogin() && !oidcGate(w, r, tunnelClient) {
+			return
+		}
+
+		// Don't bother the client while its local service is down.
+		if !tunnelClient.Healthy() {
+			w.Header().Set("Retry-After", "5")
+			renderError(w, r, http.StatusServiceUnavailable, errorServiceStarting, "")
+			return
+		}
+
+		// Only requests that will actually reach the client count here.
+		if ok, wait := tunnelRateLimiter.Allow(tunnelClient.Name); !ok {
+			tooManyRequests(w, r, wait)
+			return
+		}
+		if !tunnelClient.Acquire(maxInflight) {
+			tooManyRequests(w, r, time.Second)
+			return
+		}
+		defer tunnelClient.Release()
+
+		quotaUser := quotaKey(tunnelClient)
+		if reason, exceeded := quotas.Exceeded(quotaUser); exceeded {
+			if quotas.ShouldNotify(quotaUser) {
+				LogInfo("Tunnel '%s': %s", tunnelClient.Name, reason)
+				e := clientEvent(EventQuotaExceeded, tunnelClient)
+				e.Reason = reason
+				events.Emit(e)
+				go tunnelClient.Notify(protocol.ControlMessage{Type: protocol.ControlQuotaExceeded, Reason: reason})
+			}
+			renderError(w, r, http.StatusTooManyRequests, errorQuotaExceeded, "This tunnel has used up its "+reason+".")
 			return
 		}
 
@@ -119,41 +470,93 @@ func StartHTTPServer(registry *TunnelRegistry) {
 		stream, err := tunnelClient.Session.OpenStream()
 		if err != nil {
 			LogError("Failed to open smux stream:", err)
-			registry.Remove(target)
-			http.Error(w, "Tunnel stream open failed", http.StatusBadGateway)
+			registry.Remove(tunnelClient)
+			renderError(w, r, http.StatusBadGateway, errorTunnelFailed, "")
 			return
 		}
 		defer stream.Close()
 
+		protocol.RemoveHopHeaders(r.Header)
+		setForwardedHeaders(r)
+		protocol.ApplyHeaderRules(r.Header, requestHeaderRules)
+
+		// Uploads are shaped too, and count against the quota even if the
+		// request then fails. Shaped transfers move the connection deadlines
+		// along as they go.
+		rc := http.NewResponseController(w)
+		if r.Body != nil && r.Body != http.NoBody {
+			upload := &shapedReader{r: r.Body, rc: rc, client: tunnelClient}
+			r.Body = upload
+			defer func() { quotas.Add(quotaUser, upload.read) }()
+		}
+
 		// Write the request over the stream.
-		stream.SetWriteDeadline(time.Now().Add(1 * time.Minute))
 		if err := WriteFramedRequest(stream, r); err != nil {
 			LogError("Failed to write to tunnel stream:", err)
 			// Only remove client if the session is broken, not on per-request error
 			// registry.Remove(target)
-			http.Error(w, "Tunnel write failed", http.StatusBadGateway)
+			tunnelFailed(w, r, err)
 			return
 		}
-		stream.SetReadDeadline(time.Now().Add(1 * time.Minute))
 		resp, err := ReadFramedResponse(stream, r)
 		if err != nil {
 			LogError("Failed to read from tunnel stream:", err)
 			// Only remove client if the session is broken, not on per-request error
 			// registry.Remove(target)
-			http.Error(w, "Tunnel response failed", http.StatusBadGateway)
+			tunnelFailed(w, r, err)
 			return
 		}
 		defer resp.Body.Close()
 		stream.SetWriteDeadline(time.Time{})
-		stream.SetReadDeadline(time.Time{})
+
+		// The client reached us but not its local service. Show that instead
+		// of a tunnel error, unless the client sent its own offline page.
+		if code, failed := protocol.TakeUpstreamError(resp.Header); failed {
+			LogDebug("Tunnel '%s' could not reach its local service: %s", tunnelClient.Name, code)
+			if resp.ContentLength == 0 || wantsJSON(r) {
+				renderError(w, r, protocol.UpstreamErrorStatus(code), code, "")
+				return
+			}
+		}
+
+		protocol.RemoveHopHeaders(resp.Header)
+		protocol.ApplyHeaderRules(resp.Header, responseHeaderRules)
 
 		// Copy response headers and body.
 		for k, vals := range resp.Header {
 			w.Header()[k] = vals
 		}
+		rc.SetWriteDeadline(time.Now().Add(chunkTimeout))
 		w.WriteHeader(resp.StatusCode)
-		io.Copy(w, resp.Body)
-	})
+		shaped := &shapedWriter{w: w, rc: rc, client: tunnelClient}
+		io.Copy(shaped, resp.Body)
+		quotas.Add(quotaUser, shaped.written)
+	}
+}
+
+// listenAndServe is srv.ListenAndServe, or ListenAndServeTLS when srv has a
+// TLSConfig, on a listener that may read PROXY protocol headers.
+func listenAndServe(name string, srv *http.Server) error {
+	ln, err := listen(name, srv.Addr)
+	if err != nil {
+		return err
+	}
+	if srv.TLSConfig != nil {
+		return srv.ServeTLS(ln, "", "")
+	}
+	return srv.Serve(ln)
+}
+
+// startHTTPServer starts an HTTP server that, on each request, opens a new smux stream.
+func StartHTTPServer(registry *TunnelRegistry) {
+	devMode := os.Getenv("NGOPEN_MODE") == "DEV"
+	addr := ":8080"
+	if devMode {
+		addr = ":8080"
+	}
+
+	auditStartup()
+	http.HandleFunc("/", proxyHandler(registry))
 
 	serve := &http.Server{
 		Addr:           addr,
@@ -162,9 +565,42 @@ func StartHTTPServer(registry *TunnelRegistry) {
 		MaxHeaderBytes: 1 << 20,
 	}
 
+	trackServer(serve)
+
+	// Custom domains get certificates from Let's Encrypt once verified.
+	if tlsAddr := os.Getenv("NGOPEN_TLS_ADDR"); tlsAddr != "" {
+		certCache := os.Getenv("NGOPEN_CERT_CACHE")
+		if certCache == "" {
+			certCache = "certs"
+		}
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      autocert.DirCache(certCache),
+			HostPolicy: domains.HostPolicy,
+			Email:      os.Getenv("NGOPEN_ACME_EMAIL"),
+		}
+		serve.Handler = manager.HTTPHandler(http.DefaultServeMux)
+		tlsServe := &http.Server{
+			Addr:           tlsAddr,
+			TLSConfig:      manager.TLSConfig(),
+			ReadTimeout:    30 * time.Second,
+			WriteTimeout:   30 * time.Second,
+			MaxHeaderBytes: 1 << 20,
+		}
+		trackServer(tlsServe)
+		go func() {
+			LogInfo("HTTPS server (custom domains) listening on %s", tlsAddr)
+			if err := serveUntilDrained(func() error { return listenAndServe("https", tlsServe) }); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
+
 	if devMode {
 		LogInfo("HTTP server (dev mode) listening on %s", addr)
-		log.Fatal(serve.ListenAndServe())
+		if err := serveUntilDrained(func() error { return listenAndServe("http", serve) }); err != nil {
+			log.Fatal(err)
+		}
 	} else {
 		// certFile := os.Getenv("NGOPEN_CERT_FILE")
 		// keyFile := os.Getenv("NGOPEN_KEY_FILE")
@@ -176,6 +612,8 @@ func StartHTTPServer(registry *TunnelRegistry) {
 		// }
 		//Will be handled by the reverse proxy in production
 		LogInfo("HTTPS server (prod mode) listening on %s", addr)
-		log.Fatal(serve.ListenAndServe())
+		if err := serveUntilDrained(func() error { return listenAndServe("http", serve) }); err != nil {
+			log.Fatal(err)
+		}
 	}
 }
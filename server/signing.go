@@ -0,0 +1,64 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+)
+
+var sessionSecret = loadSessionSecret()
+
+func loadSessionSecret() []byte {
+	if s := os.Getenv("NGOPEN_SESSION_SECRET"); s != "" {
+		return []byte(s)
+	}
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	return secret
+}
+
+// signValue encodes v as JSON and appends an HMAC so it can be handed to a
+// browser (cookies, OAuth state) and trusted when it comes back.
+func signValue(v interface{}) (string, error) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, sessionSecret)
+	mac.Write(payload)
+	return base64.RawURLEncoding.EncodeToString(payload) + "." +
+		base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// verifyValue checks a value produced by signValue and decodes it into v.
+func verifyValue(signed string, v interface{}) error {
+	encPayload, encSig, ok := strings.Cut(signed, ".")
+	if !ok {
+		return errors.New("malformed signed value")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encPayload)
+	if err != nil {
+		return err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(encSig)
+	if err != nil {
+		return err
+	}
+	mac := hmac.New(sha256.New, sessionSecret)
+	mac.Write(payload)
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return errors.New("bad signature")
+	}
+	return json.Unmarshal(payload, v)
+}
+
+func randomToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
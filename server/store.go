@@ -0,0 +1,257 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// maxHistory bounds how many finished tunnels the store remembers.
+const maxHistory = 1000
+
+// TunnelHistory describes one finished tunnel connection.
+type TunnelHistory struct {
+	Hostname       string    `json:"hostname"`
+	UserID         string    `json:"userId"`
+	Domain         string    `json:"domain,omitempty"`
+	RemoteAddr     string    `json:"remoteAddr"`
+	ConnectedAt    time.Time `json:"connectedAt"`
+	DisconnectedAt time.Time `json:"disconnectedAt"`
+}
+
+// ResumeRecord is the latest resume secret issued for a hostname. Only the
+// hash of the secret is kept; an empty hash means secrets were revoked.
+type ResumeRecord struct {
+	UserID     string    `json:"userId"`
+	SecretHash string    `json:"secretHash"`
+	Expires    time.Time `json:"expires"`
+}
+
+// Store persists what must survive a server restart. NewFileStore is the
+// built-in implementation; others can be plugged in via the store variable.
+type Store interface {
+	// Reservation returns the user a hostname is reserved for.
+	Reservation(hostname string) (string, bool)
+	Reserve(hostname, userID string) error
+	// Unreserve drops the reservation, as long as it belongs to userID.
+	Unreserve(hostname, userID string) error
+	SaveDomain(domain CustomDomain) error
+	Domains() []CustomDomain
+	SaveResume(hostname string, record ResumeRecord) error
+	Resume(hostname string) (ResumeRecord, bool)
+	// DropResume forgets the resume record, as long as it is still the one
+	// for the secret hashed as secretHash.
+	DropResume(hostname, secretHash string) error
+	AppendHistory(entry TunnelHistory) error
+	History() []TunnelHistory
+	// QuotaUsage returns the saved transfer counters, keyed by period and
+	// user (see quotaUsageKey).
+	QuotaUsage() map[string]int64
+	// SaveQuotaUsage replaces the saved transfer counters.
+	SaveQuotaUsage(usage map[string]int64) error
+}
+
+var store Store = openStoreFromEnv()
+
+func openStoreFromEnv() Store {
+	path := os.Getenv("NGOPEN_STORE_PATH")
+	s, err := NewFileStore(path)
+	if err != nil {
+		LogError("Failed to open store %s, falling back to memory: %v", path, err)
+		s, _ = NewFileStore("")
+	}
+	return s
+}
+
+type fileStoreData struct {
+	Reservations map[string]string       `json:"reservations"`
+	Domains      map[string]CustomDomain `json:"domains"`
+	Resume       map[string]ResumeRecord `json:"resume"`
+	History      []TunnelHistory         `json:"history"`
+	QuotaUsage   map[string]int64        `json:"quotaUsage,omitempty"`
+}
+
+// fileStore keeps everything in memory and rewrites a JSON file on every
+// change. With an empty path nothing is written to disk.
+type fileStore struct {
+	sync.RWMutex
+	path string
+	data fileStoreData
+}
+
+func NewFileStore(path string) (Store, error) {
+	s := &fileStore{
+		path: path,
+		data: fileStoreData{
+			Reservations: make(map[string]string),
+			Domains:      make(map[string]CustomDomain),
+			Resume:       make(map[string]ResumeRecord),
+		},
+	}
+	if path == "" {
+		return s, nil
+	}
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(raw, &s.data); err != nil {
+		return nil, fmt.Errorf("corrupt store: %w", err)
+	}
+	if s.data.Reservations == nil {
+		s.data.Reservations = make(map[string]string)
+	}
+	if s.data.Domains == nil {
+		s.data.Domains = make(map[string]CustomDomain)
+	}
+	if s.data.Resume == nil {
+		s.data.Resume = make(map[string]ResumeRecord)
+	}
+	LogInfo("Loaded store %s: %d reservation(s), %d domain(s)", path, len(s.data.Reservations), len(s.data.Domains))
+	return s, nil
+}
+
+// save writes the data atomically. Callers must hold the write lock.
+func (s *fileStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+	raw, err := json.MarshalIndent(s.data, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), ".ngopen-store-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(raw); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+func (s *fileStore) Reservation(hostname string) (string, bool) {
+	s.RLock()
+	defer s.RUnlock()
+	user, ok := s.data.Reservations[hostname]
+	return user, ok
+}
+
+func (s *fileStore) Reserve(hostname, userID string) error {
+	s.Lock()
+	defer s.Unlock()
+	if owner, ok := s.data.Reservations[hostname]; ok {
+		if owner != userID {
+			return fmt.Errorf("hostname %s is reserved by another user", hostname)
+		}
+		return nil
+	}
+	s.data.Reservations[hostname] = userID
+	return s.save()
+}
+
+func (s *fileStore) Unreserve(hostname, userID string) error {
+	s.Lock()
+	defer s.Unlock()
+	if owner, ok := s.data.Reservations[hostname]; !ok || owner != userID {
+		return nil
+	}
+	delete(s.data.Reservations, hostname)
+	return s.save()
+}
+
+func (s *fileStore) SaveDomain(domain CustomDomain) error {
+	s.Lock()
+	defer s.Unlock()
+	s.data.Domains[domain.Domain] = domain
+	return s.save()
+}
+
+func (s *fileStore) Domains() []CustomDomain {
+	s.RLock()
+	defer s.RUnlock()
+	out := make([]CustomDomain, 0, len(s.data.Domains))
+	for _, d := range s.data.Domains {
+		out = append(out, d)
+	}
+	return out
+}
+
+func (s *fileStore) SaveResume(hostname string, record ResumeRecord) error {
+	s.Lock()
+	defer s.Unlock()
+	now := time.Now()
+	for h, r := range s.data.Resume {
+		if now.After(r.Expires) {
+			delete(s.data.Resume, h)
+		}
+	}
+	s.data.Resume[hostname] = record
+	return s.save()
+}
+
+func (s *fileStore) Resume(hostname string) (ResumeRecord, bool) {
+	s.RLock()
+	defer s.RUnlock()
+	r, ok := s.data.Resume[hostname]
+	return r, ok
+}
+
+func (s *fileStore) DropResume(hostname, secretHash string) error {
+	s.Lock()
+	defer s.Unlock()
+	if r, ok := s.data.Resume[hostname]; !ok || r.SecretHash != secretHash {
+		return nil
+	}
+	delete(s.data.Resume, hostname)
+	return s.save()
+}
+
+func (s *fileStore) AppendHistory(entry TunnelHistory) error {
+	s.Lock()
+	defer s.Unlock()
+	s.data.History = append(s.data.History, entry)
+	if len(s.data.History) > maxHistory {
+		s.data.History = s.data.History[len(s.data.History)-maxHistory:]
+	}
+	return s.save()
+}
+
+func (s *fileStore) History() []TunnelHistory {
+	s.RLock()
+	defer s.RUnlock()
+	return append([]TunnelHistory(nil), s.data.History...)
+}
+
+func (s *fileStore) QuotaUsage() map[string]int64 {
+	s.RLock()
+	defer s.RUnlock()
+	return maps.Clone(s.data.QuotaUsage)
+}
+
+func (s *fileStore) SaveQuotaUsage(usage map[string]int64) error {
+	s.Lock()
+	defer s.Unlock()
+	s.data.QuotaUsage = maps.Clone(usage)
+	return s.save()
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
@@ -2,8 +2,9 @@ package server
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
-	"fmt"
 	"net/http"
 	"os"
 )
@@ -14,31 +15,41 @@ type APIResponse struct {
 	UserID string `json:"userId,omitempty"`
 }
 
+// TokenFingerprint identifies a token in logs and limits without exposing it.
+func TokenFingerprint(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:8])
+}
+
 func IsValidToken(token string) bool {
+	return ValidateToken(token).Valid
+}
+
+// ValidateToken asks the validation API about token and returns its full
+// answer, including the UserID the token belongs to.
+func ValidateToken(token string) APIResponse {
 	apiURL := os.Getenv("API_VALIDATE_URL")
 	if apiURL == "" {
 		LogError("API_VALIDATE_URL is not set")
-		return false
+		return APIResponse{}
 	}
-	fmt.Println("API_VALIDATE_URL", apiURL)
 	payload := map[string]string{"key": token}
 	body, _ := json.Marshal(payload)
-	fmt.Println("body", string(body))
 
 	req, err := http.NewRequest("POST", apiURL, bytes.NewBuffer(body))
 	if err != nil {
-		return false
+		return APIResponse{}
 	}
 	req.Header.Set("Content-Type", "application/json")
 
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return false
+		return APIResponse{}
 	}
 	defer resp.Body.Close()
 
 	var result APIResponse
 	json.NewDecoder(resp.Body).Decode(&result)
 	LogInfo("API Response: %+v", result)
-	return result.Valid
+	return result
 }